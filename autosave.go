@@ -0,0 +1,144 @@
+/*
+ * File:	autosave.go
+ *
+ * Implements saving databases periodically in the background.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"sync"
+	"time"
+)
+
+// An Autosaver saves a Db or a Mux periodically in the background, each time
+// writing only the databases that changed since the last save. Create one
+// with AutosaveDb or AutosaveMux, and stop it with Close, which saves one last
+// time.
+type Autosaver struct {
+	mu      sync.Mutex // serializes saves
+	save    func() error
+	onError func(error)
+	done    chan struct{}
+	wg      sync.WaitGroup
+	close   sync.Once
+	err     error // the error of the final save
+	saved   func(tick time.Time, err error)
+}
+
+// testHookAutosaved, if not nil, is called by Autosavers started while it is
+// set with the time of each tick of their clock and the result of the save
+// it caused, so that tests can wait for periodic saves.
+var testHookAutosaved func(tick time.Time, err error)
+
+// AutosaveDb starts saving db to the file at path, as by Db.SaveFile, every
+// interval of db's clock (see WithClock), provided it has changed since the
+// last save. Errors saving are passed to onError, if it isn't nil; a failed
+// save is tried again at the next interval.
+func AutosaveDb(db *Db, path string, interval time.Duration, onError func(error)) *Autosaver {
+	saved, first := uint64(0), true
+	return autosave(func() error {
+		updates := db.changes()
+		if !first && updates == saved {
+			return nil
+		}
+		if err := db.SaveFile(path); err != nil {
+			return err
+		}
+		saved, first = updates, false
+		return nil
+	}, db.clockOrSystem(), interval, onError)
+}
+
+// AutosaveMux starts saving mux to directory dir, as by Mux.SaveDir, every
+// interval of mux's clock (see WithMuxClock). Only the databases that changed
+// since the last save are written. Errors saving are passed to onError, if it
+// isn't nil; a failed save is tried again at the next interval.
+func AutosaveMux(mux *Mux, dir string, interval time.Duration, onError func(error)) *Autosaver {
+	return autosave(func() error {
+		return mux.SaveDir(dir)
+	}, clockOrSystem(mux.clock), interval, onError)
+}
+
+// autosave starts an Autosaver calling save every interval of clock.
+func autosave(save func() error, clock Clock, interval time.Duration, onError func(error)) *Autosaver {
+	if interval <= 0 {
+		panic("Autosave interval must be positive.")
+	}
+
+	a := &Autosaver{save: save, onError: onError, done: make(chan struct{}),
+		saved: testHookAutosaved}
+	ticker := clock.NewTicker(interval)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case tick := <-ticker.C():
+				err := a.Save()
+				if err != nil && a.onError != nil {
+					a.onError(err)
+				}
+				if a.saved != nil {
+					a.saved(tick, err)
+				}
+			case <-a.done:
+				return
+			}
+		}
+	}()
+	return a
+}
+
+// Save saves whatever has changed right away, returning any error. It doesn't
+// affect when the next periodic save happens.
+func (a *Autosaver) Save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.save()
+}
+
+// Close stops the periodic saves and saves one last time, returning any error
+// from that final save. Calling Close again returns the same error.
+func (a *Autosaver) Close() error {
+	a.close.Do(func() {
+		close(a.done)
+		a.wg.Wait()
+		a.err = a.Save()
+	})
+	return a.err
+}
+
+// changes returns the number of changes made to the database so far, which
+// tells savers whether it has changed since they last saved it.
+func (db *Db) changes() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.updates
+}
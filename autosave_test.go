@@ -0,0 +1,112 @@
+/*
+ * File:	autosave_test.go
+ *
+ * Implements tests for the autosave.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutosaveDb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.gar")
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5)
+
+	a := AutosaveDb(db, path, time.Hour, func(err error) {
+		t.Errorf("autosave failed: %v", err)
+	})
+	if err := a.Save(); err != nil {
+		t.Fatalf("a.Save returned %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("first save wrote no file: %v", err)
+	}
+
+	// An unchanged database isn't written again
+	os.Chtimes(path, info.ModTime(), time.Unix(0, 0))
+	if err := a.Save(); err != nil {
+		t.Fatalf("a.Save returned %v", err)
+	}
+	if info, _ := os.Stat(path); !info.ModTime().Equal(time.Unix(0, 0)) {
+		t.Errorf("unchanged database was saved again")
+	}
+
+	// Close saves the last changes
+	db.AddAt(5, base)
+	if err := a.Close(); err != nil {
+		t.Fatalf("a.Close returned %v", err)
+	}
+	loaded := new(Db)
+	if err := loaded.LoadFile(path); err != nil || !loaded.equals(db) {
+		t.Errorf("LoadFile after Close returned %v, or a different database", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("second a.Close returned %v", err)
+	}
+}
+
+func TestAutosavePeriodic(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mux")
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	clock := NewFakeClock(base)
+	mux := NewMux(WithMuxClock(clock))
+	mux.AddDb("a", New(30*time.Second, 5))
+
+	errs := make(chan error, 1)
+	testHookAutosaved = func(tick time.Time, err error) {
+		errs <- err
+	}
+	defer func() { testHookAutosaved = nil }()
+	a := AutosaveMux(mux, dir, time.Minute, nil)
+	defer a.Close()
+
+	for i := 0; i < 10; i++ {
+		mux.AddAt(float32(i), base.Add(time.Duration(i*30)*time.Second))
+		clock.Advance(time.Minute)
+		if err := <-errs; err != nil {
+			t.Fatalf("autosave failed: %v", err)
+		}
+
+		loaded, err := LoadDir(dir)
+		if err != nil {
+			t.Fatalf("LoadDir returned %v", err)
+		}
+		got, _ := loaded.Get("a")
+		want, _ := mux.Get("a")
+		if got == nil || !got.equals(want) {
+			t.Fatalf("autosaved mux doesn't match after sample %d", i)
+		}
+	}
+}
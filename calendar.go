@@ -0,0 +1,137 @@
+/*
+ * File:	calendar.go
+ *
+ * Implements timeboxes that follow the calendar: weeks, months and years.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Calendar is a unit of the calendar, which the timeboxes of a database
+// created by NewCalendar each cover one of. Such timeboxes vary in length
+// along with the calendar.
+type Calendar int
+
+const (
+	// Week timeboxes are ISO 8601 weeks, which start on Monday.
+	Week Calendar = iota + 1
+
+	// Month timeboxes are calendar months.
+	Month
+
+	// Quarter timeboxes are the quarters of the year, starting in
+	// January, April, July and October.
+	Quarter
+
+	// Year timeboxes are calendar years.
+	Year
+)
+
+var calendarNames = []string{"WEEK", "MONTH", "QUARTER", "YEAR"}
+
+func (c Calendar) valid() bool {
+	return c >= Week && int(c) <= len(calendarNames)
+}
+
+func (c Calendar) String() string {
+	if !c.valid() {
+		return fmt.Sprintf("Calendar(%d)", int(c))
+	}
+	return calendarNames[c-1]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, giving the
+// unit's name as returned by String.
+func (c Calendar) MarshalText() ([]byte, error) {
+	if !c.valid() {
+		return nil, fmt.Errorf("goaround: unknown calendar unit %d", int(c))
+	}
+	return []byte(calendarNames[c-1]), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, accepting
+// the names returned by String.
+func (c *Calendar) UnmarshalText(b []byte) error {
+	for i, name := range calendarNames {
+		if string(b) == name {
+			*c = Calendar(i + 1)
+			return nil
+		}
+	}
+	return fmt.Errorf("goaround: unknown calendar unit %q", b)
+}
+
+// NewCalendar creates and returns a new Db whose timeboxes each cover one unit
+// of the calendar, with the specified capacity. The calendar is read on the
+// wall clock of UTC, or of the location configured by WithLocation, and
+// WithOffset shifts the start of each unit, so that, for example, weeks can
+// start at 6am on Monday. The options are otherwise the same as for New. Such
+// a database can be saved with SaveFile, but not kept in a database file (see
+// Create), whose fixed layout has no room for the unit.
+func NewCalendar(unit Calendar, capacity int, opts ...Option) *Db {
+	if !unit.valid() {
+		panic("Unknown calendar unit.")
+	}
+	return newDb(boxing{unit: unit}, capacity, opts)
+}
+
+// Calendar returns the unit of the calendar each of the database's timeboxes
+// covers, or zero if the database wasn't created by NewCalendar.
+func (db *Db) Calendar() Calendar {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.unit
+}
+
+// chunk returns the start and stop times of the unit of the calendar that t,
+// a time read off a wall clock as though it were in UTC, falls in.
+func (c Calendar) chunk(t time.Time) (start time.Time, stop time.Time) {
+	year, month, day := t.Date()
+	switch c {
+	case Week:
+		day -= (int(t.Weekday()) + 6) % 7
+		start = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		stop = start.AddDate(0, 0, 7)
+	case Month:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		stop = start.AddDate(0, 1, 0)
+	case Quarter:
+		start = time.Date(year, (month-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+		stop = start.AddDate(0, 3, 0)
+	case Year:
+		start = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		stop = start.AddDate(1, 0, 0)
+	default:
+		panic("Unknown calendar unit.")
+	}
+	return
+}
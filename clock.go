@@ -0,0 +1,240 @@
+/*
+ * File:	clock.go
+ *
+ * Implements the clocks databases and autosavers tell the time by.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the time, for the methods that add a sample at the current
+// time, and ticks, for periodic work such as autosaving. Databases and Muxes
+// use the system clock unless configured with another by WithClock or
+// WithMuxClock. A FakeClock lets tests and simulations control the time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker delivers ticks on the channel returned by C, in the manner of a
+// time.Ticker, until it is stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the Clock of the system, as told by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
+
+// clockOrSystem returns c, or the system clock if c is nil.
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+// WithClock configures the database to tell the time by c, rather than the
+// system clock, when adding a sample at the current time with Add or
+// AddCounter, and when autosaved (see AutosaveDb).
+func WithClock(c Clock) Option {
+	if c == nil {
+		panic("Nil clock.")
+	}
+	return func(db *Db) {
+		db.clock = c
+	}
+}
+
+// SetClock makes the database tell the time by c, as WithClock does for a new
+// database, which is of use for one that was loaded rather than created by
+// New, such as by Open, OpenMapped or LoadFile. A nil c selects the system
+// clock. An Autosaver already started for the database keeps its old clock.
+func (db *Db) SetClock(c Clock) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.clock = c
+}
+
+// clockOrSystem returns the database's clock, or the system clock if it has
+// none.
+func (db *Db) clockOrSystem() Clock {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return clockOrSystem(db.clock)
+}
+
+// WithMuxClock configures the Mux to tell the time by c, rather than the
+// system clock, when adding a sample at the current time with Add, and when
+// autosaved (see AutosaveMux). Databases the Mux loads from a directory (see
+// LoadDir) are given c as their clock too.
+func WithMuxClock(c Clock) MuxOption {
+	if c == nil {
+		panic("Nil clock.")
+	}
+	return func(mux *Mux) {
+		mux.clock = c
+	}
+}
+
+// A FakeClock is a Clock whose time only moves when it is told to, by Set or
+// Advance. Its tickers tick as the time passes each of their periods; like a
+// time.Ticker's, ticks are dropped rather than queued for a receiver that
+// falls behind, so advancing the clock by many periods at once delivers a
+// single tick.
+//
+// A FakeClock is safe for concurrent use by multiple goroutines.
+type FakeClock struct {
+	mu      sync.Mutex // guards everything below
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock creates and returns a FakeClock set to t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now returns the time the clock is set to.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, ticking any tickers whose period has
+// passed. A negative d panics.
+func (c *FakeClock) Advance(d time.Duration) {
+	if d < 0 {
+		panic("Negative clock advance.")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set sets the clock to t, which must not be before the time it is already
+// set to, ticking any tickers whose period has passed.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.Before(c.now) {
+		panic("Fake clock set backwards.")
+	}
+	c.set(t)
+}
+
+// set implements Set.
+func (c *FakeClock) set(t time.Time) {
+	c.now = t
+	live := c.tickers[:0]
+	for _, tk := range c.tickers {
+		if tk.stopped() {
+			continue
+		}
+		live = append(live, tk)
+		tk.advance(t)
+	}
+	clear(c.tickers[len(live):])
+	c.tickers = live
+}
+
+// NewTicker returns a Ticker that ticks every d from the time the clock is set
+// to now. A d that isn't positive panics, as for time.NewTicker.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("Non-positive interval for NewTicker.")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tk := &fakeTicker{c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, tk)
+	return tk
+}
+
+type fakeTicker struct {
+	c      chan time.Time
+	period time.Duration
+	next   time.Time // time of the next tick; guarded by the clock's mu
+	mu     sync.Mutex
+	stop   bool
+}
+
+// advance delivers the tick due by time t, if there is one, and schedules the
+// next tick after t.
+func (tk *fakeTicker) advance(t time.Time) {
+	if t.Before(tk.next) {
+		return
+	}
+	last := tk.next.Add(t.Sub(tk.next) / tk.period * tk.period)
+	select {
+	case tk.c <- last:
+	default:
+	}
+	tk.next = last.Add(tk.period)
+}
+
+func (tk *fakeTicker) C() <-chan time.Time {
+	return tk.c
+}
+
+func (tk *fakeTicker) Stop() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.stop = true
+}
+
+func (tk *fakeTicker) stopped() bool {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return tk.stop
+}
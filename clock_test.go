@@ -0,0 +1,223 @@
+/*
+ * File:	clock_test.go
+ *
+ * Implements tests for the clock.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	clock := NewFakeClock(base)
+	ticker := clock.NewTicker(time.Minute)
+
+	if now := clock.Now(); !now.Equal(base) {
+		t.Errorf("clock.Now() = %v, want %v", now, base)
+	}
+	clock.Advance(59 * time.Second)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("ticker ticked at %v, before its period passed", tick)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if tick := <-ticker.C(); !tick.Equal(base.Add(time.Minute)) {
+		t.Errorf("ticker ticked at %v, expected %v", tick, base.Add(time.Minute))
+	}
+
+	// Ticks nobody receives are dropped, and the ticker keeps to its period
+	clock.Set(base.Add(10*time.Minute + 30*time.Second))
+	if tick := <-ticker.C(); !tick.Equal(base.Add(10 * time.Minute)) {
+		t.Errorf("ticker ticked at %v, expected %v", tick, base.Add(10*time.Minute))
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("ticker ticked again at %v", tick)
+	default:
+	}
+	clock.Advance(30 * time.Second)
+	if tick := <-ticker.C(); !tick.Equal(base.Add(11 * time.Minute)) {
+		t.Errorf("ticker ticked at %v, expected %v", tick, base.Add(11*time.Minute))
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("stopped ticker ticked at %v", tick)
+	default:
+	}
+}
+
+func TestClockAdd(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	clock := NewFakeClock(base)
+	db := New(30*time.Second, 5, WithClock(clock))
+	counter := New(30*time.Second, 5, WithClock(clock), WithDataSource(Counter))
+	multi := NewMulti([]Archive{{30 * time.Second, 5}, {time.Minute, 5}}, WithClock(clock))
+	mux := NewMux(WithMuxClock(clock))
+	mux.AddDb("a", New(30*time.Second, 5))
+
+	want := New(30*time.Second, 5)
+	wantCounter := New(30*time.Second, 5, WithDataSource(Counter))
+	for i := 0; i < 10; i++ {
+		for _, err := range []error{db.Add(float32(i)), counter.AddCounter(uint64(i * 100)),
+			multi.Add(float32(i)), mux.Add(float32(i))} {
+			if err != nil {
+				t.Fatalf("Adding sample %d returned %v", i, err)
+			}
+		}
+		want.AddAt(float32(i), clock.Now())
+		wantCounter.AddCounterAt(uint64(i*100), clock.Now())
+		clock.Advance(20 * time.Second)
+	}
+
+	a, _ := mux.Get("a")
+	for _, got := range []*Db{db, multi.Archives()[0], a} {
+		if !got.equals(want) {
+			t.Errorf("db added to at the fake clock's time does not match")
+		}
+	}
+	if !counter.equals(wantCounter) {
+		t.Errorf("counter added to at the fake clock's time does not match")
+	}
+	if s := db.Snapshot(); s.clock != clock {
+		t.Errorf("snapshot lost the database's clock")
+	}
+}
+
+func TestClockAutosave(t *testing.T) {
+	dir := t.TempDir()
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	clock := NewFakeClock(base)
+	db := New(30*time.Second, 5, WithClock(clock))
+	mux := NewMux(WithMuxClock(clock))
+	mux.AddDb("a", db)
+
+	ticks := make(chan time.Time, 10)
+	testHookAutosaved = func(tick time.Time, err error) {
+		if err != nil {
+			t.Errorf("autosave failed: %v", err)
+		}
+		ticks <- tick
+	}
+	defer func() { testHookAutosaved = nil }()
+	path := filepath.Join(dir, "db.gar")
+	adb := AutosaveDb(db, path, time.Hour, nil)
+	defer adb.Close()
+	amux := AutosaveMux(mux, filepath.Join(dir, "mux"), time.Hour, nil)
+	defer amux.Close()
+
+	// Nothing is saved until the clock passes the interval, so each first
+	// saves at the tick an hour on, however the clock gets there
+	db.Add(1)
+	clock.Advance(59 * time.Minute)
+	clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		if tick := <-ticks; !tick.Equal(base.Add(time.Hour)) {
+			t.Errorf("autosave saved at %v, expected %v", tick, base.Add(time.Hour))
+		}
+	}
+
+	loaded := new(Db)
+	if err := loaded.LoadFile(path); err != nil || !loaded.equals(db) {
+		t.Errorf("LoadFile returned %v, or a different database", err)
+	}
+	loadedMux, err := LoadDir(filepath.Join(dir, "mux"))
+	if err != nil {
+		t.Fatalf("LoadDir returned %v", err)
+	}
+	if a, err := loadedMux.Load("a"); err != nil || !a.equals(db) {
+		t.Errorf("loadedMux.Load returned %v, or a different database", err)
+	}
+}
+
+// Databases that are loaded rather than created by New can be given a clock too
+func TestClockLoaded(t *testing.T) {
+	dir := t.TempDir()
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	clock := NewFakeClock(base)
+
+	created, err := Create(filepath.Join(dir, "db.grd"), 30*time.Second, 5)
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	created.Close()
+	saved := New(30*time.Second, 5)
+	if err := saved.SaveFile(filepath.Join(dir, "db.gar")); err != nil {
+		t.Fatalf("SaveFile returned %v", err)
+	}
+	mux := NewMux()
+	mux.AddDb("a", saved)
+	if err := mux.SaveDir(filepath.Join(dir, "mux")); err != nil {
+		t.Fatalf("SaveDir returned %v", err)
+	}
+
+	opened, err := Open(filepath.Join(dir, "db.grd"))
+	if err != nil {
+		t.Fatalf("Open returned %v", err)
+	}
+	defer opened.Close()
+	opened.SetClock(clock)
+	loaded := new(Db)
+	if err := loaded.LoadFile(filepath.Join(dir, "db.gar")); err != nil {
+		t.Fatalf("LoadFile returned %v", err)
+	}
+	loaded.SetClock(clock)
+	loadedMux, err := LoadDir(filepath.Join(dir, "mux"), WithMuxClock(clock))
+	if err != nil {
+		t.Fatalf("LoadDir returned %v", err)
+	}
+	fromMux, err := loadedMux.Load("a")
+	if err != nil {
+		t.Fatalf("loadedMux.Load returned %v", err)
+	}
+
+	want := New(30*time.Second, 5)
+	for i := 0; i < 10; i++ {
+		for _, db := range []*Db{opened, loaded, fromMux} {
+			if err := db.Add(float32(i)); err != nil {
+				t.Fatalf("Adding sample %d returned %v", i, err)
+			}
+		}
+		want.AddAt(float32(i), clock.Now())
+		clock.Advance(20 * time.Second)
+	}
+	for _, got := range []*Db{opened, loaded, fromMux} {
+		if !got.equals(want) {
+			t.Errorf("loaded db added to at the fake clock's time does not match")
+		}
+	}
+}
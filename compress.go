@@ -0,0 +1,370 @@
+/*
+ * File:	compress.go
+ *
+ * Implements compressed storage of database entries.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+)
+
+/*****************************************************************************/
+// What follows is a compressed encoding of database entries, after the one
+// Facebook's Gorilla uses for floating point values. Each value is XORed with
+// the one before it; values that are unchanged then take a single bit, and
+// values that change only a little take not much more, since most of the
+// bits of the XOR are zero. Written as bits:
+//
+//	first value              32 bits, as is
+//	same as the previous     0
+//	meaningful bits of the   10, then the XOR's bits within the window of
+//	XOR fit in the window      the previous 11 case
+//	otherwise                11, then 5 bits of leading zeros, 5 bits of
+//	                           the number of meaningful bits less one, and
+//	                           the meaningful bits; these become the window
+//
+// Slowly changing or flat data, including long runs of unknown values,
+// compresses to a small fraction of its size.
+/*****************************************************************************/
+
+var errCorrupt = errors.New("goaround: corrupt compressed entries")
+
+// WithCompression configures the database to compress its entries in the
+// encoding above when it is encoded with GobEncode (and so also when saved
+// with SaveFile). Whether a database is compressed is itself saved, so a
+// database decoded from compressed data stays compressed. Databases kept in
+// a file by Create or Open are not compressed, as their entries must stay
+// where they are in the file.
+func WithCompression() Option {
+	return func(db *Db) {
+		db.compress = true
+	}
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	b    []byte
+	free uint // unused bits in the last byte
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if w.free == 0 {
+			w.b = append(w.b, 0)
+			w.free = 8
+		}
+		take := min(n, w.free)
+		chunk := byte(v>>(n-take)) & (1<<take - 1)
+		w.b[len(w.b)-1] |= chunk << (w.free - take)
+		w.free -= take
+		n -= take
+	}
+}
+
+// bitReader reads bits written by a bitWriter. Reading past the end yields
+// zeros and sets err.
+type bitReader struct {
+	b   []byte
+	pos uint // bits read so far
+	err error
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	var v uint64
+	for n > 0 {
+		i := r.pos / 8
+		if i >= uint(len(r.b)) {
+			r.err = errCorrupt
+			return 0
+		}
+		left := 8 - r.pos%8
+		take := min(n, left)
+		chunk := uint64(r.b[i]>>(left-take)) & (1<<take - 1)
+		v = v<<take | chunk
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+// xorEncoder writes a run of values to w in the encoding above.
+type xorEncoder struct {
+	w           *bitWriter
+	started     bool
+	prev        uint32
+	lead, trail uint // the window
+}
+
+func (e *xorEncoder) encode(v float32) {
+	cur := math.Float32bits(v)
+	if !e.started {
+		e.w.writeBits(uint64(cur), 32)
+		e.started, e.prev = true, cur
+		e.lead, e.trail = 32, 0
+		return
+	}
+
+	x := cur ^ e.prev
+	e.prev = cur
+	if x == 0 {
+		e.w.writeBits(0, 1)
+		return
+	}
+
+	lead, trail := uint(bits.LeadingZeros32(x)), uint(bits.TrailingZeros32(x))
+	if lead >= e.lead && trail >= e.trail {
+		e.w.writeBits(0b10, 2)
+		e.w.writeBits(uint64(x>>e.trail), 32-e.lead-e.trail)
+		return
+	}
+
+	lead = min(lead, 31)
+	e.lead, e.trail = lead, trail
+	e.w.writeBits(0b11, 2)
+	e.w.writeBits(uint64(lead), 5)
+	e.w.writeBits(uint64(32-lead-trail-1), 5)
+	e.w.writeBits(uint64(x>>trail), 32-lead-trail)
+}
+
+// xorDecoder reads a run of values written by an xorEncoder.
+type xorDecoder struct {
+	r           *bitReader
+	started     bool
+	prev        uint32
+	lead, trail uint
+}
+
+func (d *xorDecoder) decode() float32 {
+	if !d.started {
+		d.prev = uint32(d.r.readBits(32))
+		d.started = true
+		return math.Float32frombits(d.prev)
+	}
+
+	if d.r.readBits(1) == 1 {
+		if d.r.readBits(1) == 1 {
+			d.lead = uint(d.r.readBits(5))
+			d.trail = 32 - d.lead - uint(d.r.readBits(5)) - 1
+		}
+		if d.lead+d.trail > 32 {
+			d.r.err = errCorrupt
+			return 0
+		}
+		d.prev ^= uint32(d.r.readBits(32-d.lead-d.trail)) << d.trail
+	}
+	return math.Float32frombits(d.prev)
+}
+
+// packEntries encodes entries, which hold n values per timebox, one column of
+// n at a time so that each run is of like values.
+func packEntries(entries []float32, n int) []byte {
+	w := &bitWriter{b: binary.AppendUvarint(nil, uint64(len(entries)/n))}
+	for k := 0; k < n; k++ {
+		e := xorEncoder{w: w}
+		for i := k; i < len(entries); i += n {
+			e.encode(entries[i])
+		}
+	}
+	return w.b
+}
+
+// unpackEntries decodes entries packed by packEntries.
+func unpackEntries(b []byte, n int) ([]float32, error) {
+	count, used := binary.Uvarint(b)
+	if used <= 0 || n <= 0 || count > uint64(len(b))*8 {
+		return nil, errCorrupt
+	}
+
+	entries := make([]float32, int(count)*n)
+	r := &bitReader{b: b[used:]}
+	for k := 0; k < n; k++ {
+		d := xorDecoder{r: r}
+		for i := k; i < len(entries); i += n {
+			entries[i] = d.decode()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return entries, nil
+}
+
+// coldBlockSize is the number of timeboxes in each block of a ColdArchive.
+const coldBlockSize = 128
+
+// A ColdArchive is a compressed, read-only copy of the timeboxes held by a
+// database, for keeping long-retention data in memory in a fraction of the
+// space. Timeboxes are compressed in blocks, so reading one only means
+// decoding the block it's in.
+//
+// A ColdArchive is safe for concurrent use by multiple goroutines.
+type ColdArchive struct {
+	boxing
+	cfs    []Consolidation
+	oldest time.Time // start time of the timebox at index 0
+	length int
+	blocks [][]byte // column k of block j is blocks[j*len(cfs)+k]
+}
+
+// Freeze returns a ColdArchive holding the timeboxes the database holds.
+func (db *Db) Freeze() *ColdArchive {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c := &ColdArchive{
+		boxing: db.boxing,
+		cfs:    append([]Consolidation(nil), db.cfs...),
+		oldest: db.oldest(),
+		length: db.length(),
+	}
+	for j := 0; j < c.length; j += coldBlockSize {
+		for k := range db.cfs {
+			w := new(bitWriter)
+			e := xorEncoder{w: w}
+			for i := j; i < c.length && i < j+coldBlockSize; i++ {
+				e.encode(db.box(db.slot(i))[k])
+			}
+			c.blocks = append(c.blocks, w.b)
+		}
+	}
+	return c
+}
+
+// Res returns the resolution of the archive, or zero if it was frozen from a
+// database created by NewCalendar.
+func (c *ColdArchive) Res() time.Duration {
+	return c.res
+}
+
+// Consolidations returns the consolidation functions kept for each timebox.
+func (c *ColdArchive) Consolidations() []Consolidation {
+	return append([]Consolidation(nil), c.cfs...)
+}
+
+// Len returns the number of timeboxes held by the archive.
+func (c *ColdArchive) Len() int {
+	return c.length
+}
+
+// Size returns the number of bytes the archive's compressed timeboxes take up.
+func (c *ColdArchive) Size() int {
+	size := 0
+	for _, b := range c.blocks {
+		size += len(b)
+	}
+	return size
+}
+
+// Get returns the value at the indicated index, as Db.Get does for the
+// database the archive was made from.
+func (c *ColdArchive) Get(i int) float32 {
+	return c.get(i, 0)
+}
+
+// GetCF is like Get, but returns the value consolidated by cf, which must be
+// one of the archive's consolidation functions.
+func (c *ColdArchive) GetCF(i int, cf Consolidation) float32 {
+	return c.get(i, c.cfIndex(cf))
+}
+
+// get returns the value of the k'th consolidation function at index i.
+func (c *ColdArchive) get(i, k int) float32 {
+	if i < 0 || i >= c.length {
+		panic("Index out of bounds.")
+	}
+
+	d := c.decoder(i/coldBlockSize, k)
+	for ; i%coldBlockSize > 0; i-- {
+		d.decode()
+	}
+	return d.decode()
+}
+
+// decoder returns a decoder for column k of block j.
+func (c *ColdArchive) decoder(j, k int) *xorDecoder {
+	return &xorDecoder{r: &bitReader{b: c.blocks[j*len(c.cfs)+k]}}
+}
+
+// cfIndex returns the position of cf among the archive's consolidation
+// functions.
+func (c *ColdArchive) cfIndex(cf Consolidation) int {
+	for k, other := range c.cfs {
+		if other == cf {
+			return k
+		}
+	}
+	panic("Consolidation function not kept by archive.")
+}
+
+// Fetch returns one Point for each timebox that overlaps the range from start
+// (inclusive) to end (exclusive), as Db.Fetch does, except that the range is
+// clipped to the timeboxes the archive holds.
+func (c *ColdArchive) Fetch(start, end time.Time) []Point {
+	return c.fetch(0, start, end)
+}
+
+// FetchCF is like Fetch, but returns values consolidated by cf.
+func (c *ColdArchive) FetchCF(cf Consolidation, start, end time.Time) []Point {
+	return c.fetch(c.cfIndex(cf), start, end)
+}
+
+// fetch implements Fetch for the k'th consolidation function.
+func (c *ColdArchive) fetch(k int, start, end time.Time) []Point {
+	if start.Before(c.oldest) {
+		start = c.oldest
+	}
+	if stop := c.step(c.oldest, c.length); end.After(stop) {
+		end = stop
+	}
+	if !start.Before(end) {
+		return nil
+	}
+
+	t, _ := c.boxTime(start)
+	first := c.count(c.oldest, t)
+
+	var points []Point
+	var d *xorDecoder
+	for i := first - first%coldBlockSize; t.Before(end); i++ {
+		if i%coldBlockSize == 0 {
+			d = c.decoder(i/coldBlockSize, k)
+		}
+		v := d.decode()
+		if i >= first {
+			points = append(points, Point{Time: t, Value: v, Missing: IsUnknown(v)})
+			t = c.step(t, 1)
+		}
+	}
+	return points
+}
@@ -0,0 +1,227 @@
+/*
+ * File:	compress_test.go
+ *
+ * Implements tests for the compress.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPackEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		entries []float32
+	}{
+		{"empty", 1, nil},
+		{"single", 1, []float32{42}},
+		{"flat", 1, []float32{5, 5, 5, 5, 5, 5}},
+		{"changing", 1, []float32{1, 1.5, 1.25, -3, 1e30, 1e-30, 0, float32(math.Copysign(0, -1))}},
+		{"unknown", 1, []float32{unknown, unknown, 7, unknown, float32(math.Inf(1)), 7}},
+		{"columns", 3, []float32{1, 10, 100, 2, 20, 200, unknown, unknown, unknown, 4, 40, 400}},
+	}
+
+	for _, test := range tests {
+		b := packEntries(test.entries, test.n)
+		entries, err := unpackEntries(b, test.n)
+		if err != nil {
+			t.Errorf("%s: unpackEntries returned %v", test.name, err)
+			continue
+		}
+		if len(entries) != len(test.entries) {
+			t.Errorf("%s: unpacked %d entries, expected %d", test.name, len(entries), len(test.entries))
+			continue
+		}
+		for i, v := range entries {
+			if math.Float32bits(v) != math.Float32bits(test.entries[i]) {
+				t.Errorf("%s: entry %d is %v, expected %v", test.name, i, v, test.entries[i])
+			}
+		}
+
+		if len(b) > 1 {
+			if _, err := unpackEntries(b[:len(b)-1], test.n); err == nil {
+				t.Errorf("%s: unpackEntries accepted truncated data", test.name)
+			}
+		}
+	}
+}
+
+// slowDb returns a database of n timeboxes of slowly changing data, like a
+// temperature read to a tenth of a degree, with a gap of unknown timeboxes
+// part way through.
+func slowDb(n int, opts ...Option) *Db {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(60*time.Second, n, opts...)
+	for i := 0; i < n; i++ {
+		if i > n/2 && i < n/2+n/10 {
+			continue
+		}
+		v := float32(math.Round(200+100*math.Sin(float64(i)/500)) / 10)
+		db.AddAt(v, base.Add(time.Duration(i)*time.Minute))
+	}
+	return db
+}
+
+func TestColdArchive(t *testing.T) {
+	db := slowDb(1000, WithConsolidation(Average, Max, Count))
+	c := db.Freeze()
+
+	if c.Len() != db.Len() || c.Res() != db.Res() {
+		t.Fatalf("archive has length %d and resolution %d, expected %d and %d",
+			c.Len(), c.Res(), db.Len(), db.Res())
+	}
+	if size := c.Size(); size > 4*3*db.Len()/4 {
+		t.Errorf("archive takes %d bytes, expected at most a quarter of %d", size, 4*3*db.Len())
+	}
+
+	for i := 0; i < db.Len(); i++ {
+		for _, cf := range db.Consolidations() {
+			if !sameValue(c.GetCF(i, cf), db.GetCF(i, cf)) {
+				t.Errorf("%v at %d is %v, expected %v", cf, i, c.GetCF(i, cf), db.GetCF(i, cf))
+			}
+		}
+		if !sameValue(c.Get(i), db.Get(i)) {
+			t.Errorf("value at %d is %v, expected %v", i, c.Get(i), db.Get(i))
+		}
+	}
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	ranges := [][2]int{{0, 1000}, {-100, 2000}, {130, 131}, {127, 515}, {999, 1000}, {5, 5}}
+	for _, r := range ranges {
+		start := base.Add(time.Duration(r[0])*time.Minute + 30*time.Second)
+		end := base.Add(time.Duration(r[1]) * time.Minute)
+		if !sameFetch(c.FetchCF(Max, start, end), db.FetchCF(Max, start, end)) {
+			t.Errorf("archive fetch from %v to %v does not match", r[0], r[1])
+		}
+	}
+}
+
+func TestCompressedGob(t *testing.T) {
+	plain := slowDb(1000)
+	compressed := slowDb(1000, WithCompression())
+
+	a, _ := plain.GobEncode()
+	b, err := compressed.GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode returned %v", err)
+	}
+	if len(b) > len(a)/4 {
+		t.Errorf("compressed gob is %d bytes, expected at most a quarter of %d", len(b), len(a))
+	}
+
+	loaded := new(Db)
+	if err := loaded.GobDecode(b); err != nil {
+		t.Fatalf("GobDecode returned %v", err)
+	}
+	if !loaded.equals(compressed) {
+		t.Errorf("Encoded and decoded db do not match")
+	}
+
+	// An older version is written uncompressed, so older code can read it
+	b, _ = compressed.GobEncodeVersion(5)
+	loaded = new(Db)
+	if err := loaded.GobDecode(b); err != nil || !loaded.equals(plain) {
+		t.Errorf("version 5 of compressed db does not match, error %v", err)
+	}
+}
+
+func benchmarkGobEncode(b *testing.B, db *Db) {
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, _ := db.GobEncode()
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes")
+}
+
+func BenchmarkGobEncode(b *testing.B) {
+	benchmarkGobEncode(b, slowDb(10000))
+}
+
+func BenchmarkGobEncodeCompressed(b *testing.B) {
+	benchmarkGobEncode(b, slowDb(10000, WithCompression()))
+}
+
+func benchmarkGobDecode(b *testing.B, db *Db) {
+	data, _ := db.GobEncode()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		new(Db).GobDecode(data)
+	}
+}
+
+func BenchmarkGobDecode(b *testing.B) {
+	benchmarkGobDecode(b, slowDb(10000))
+}
+
+func BenchmarkGobDecodeCompressed(b *testing.B) {
+	benchmarkGobDecode(b, slowDb(10000, WithCompression()))
+}
+
+func BenchmarkGet(b *testing.B) {
+	db := slowDb(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Get(i % db.Len())
+	}
+	b.ReportMetric(float64(4*len(db.Consolidations())), "bytes/box")
+}
+
+func BenchmarkColdGet(b *testing.B) {
+	c := slowDb(10000).Freeze()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(i % c.Len())
+	}
+	b.ReportMetric(float64(c.Size())/float64(c.Len()), "bytes/box")
+}
+
+func BenchmarkFetch(b *testing.B) {
+	db := slowDb(10000)
+	start, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	end := start.Add(24 * time.Hour)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Fetch(start, end)
+	}
+}
+
+func BenchmarkColdFetch(b *testing.B) {
+	c := slowDb(10000).Freeze()
+	start, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	end := start.Add(24 * time.Hour)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Fetch(start, end)
+	}
+}
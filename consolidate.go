@@ -0,0 +1,233 @@
+/*
+ * File:	consolidate.go
+ *
+ * Implements the consolidation functions used to combine the samples that
+ * fall within a timebox into the value stored for it.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package goaround
+
+import "errors"
+import "fmt"
+
+// Consolidation identifies a function used to combine all of the samples that
+// fall within a timebox into the single value stored for that timebox. A Db
+// may keep several consolidation functions side by side for every timebox; see
+// WithConsolidation.
+type Consolidation int
+
+const (
+	// Average is the time-weighted average of the samples: each sample is
+	// weighted by the length of time since the previous sample.
+	Average Consolidation = iota
+
+	// Min is the smallest sample in the timebox.
+	Min
+
+	// Max is the largest sample in the timebox.
+	Max
+
+	// Last is the most recent sample in the timebox.
+	Last
+
+	// Sum is the total of the samples in the timebox. For data sources
+	// other than Gauge, it is the total increase (rather than the sum of
+	// the per-second rates) recorded by the samples in the timebox.
+	Sum
+
+	// Count is the number of samples in the timebox.
+	Count
+)
+
+var consolidationNames = []string{"AVERAGE", "MIN", "MAX", "LAST", "SUM", "COUNT"}
+
+func (cf Consolidation) String() string {
+	if cf < 0 || int(cf) >= len(consolidationNames) {
+		return fmt.Sprintf("Consolidation(%d)", int(cf))
+	}
+	return consolidationNames[cf]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, giving the
+// function's name as returned by String.
+func (cf Consolidation) MarshalText() ([]byte, error) {
+	if cf < 0 || int(cf) >= len(consolidationNames) {
+		return nil, fmt.Errorf("goaround: unknown consolidation function %d", int(cf))
+	}
+	return []byte(consolidationNames[cf]), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, accepting
+// the names returned by String.
+func (cf *Consolidation) UnmarshalText(b []byte) error {
+	for i, name := range consolidationNames {
+		if string(b) == name {
+			*cf = Consolidation(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("goaround: unknown consolidation function %q", b)
+}
+
+// WithConsolidation configures the consolidation functions kept for each
+// timebox. The first one is used by Get and Fetch; the others are available
+// through GetCF and FetchCF. Passing no functions, or the same function twice,
+// panics.
+func WithConsolidation(cfs ...Consolidation) Option {
+	if err := checkConsolidations(cfs); err != nil {
+		panic(err.Error())
+	}
+
+	cfs = append([]Consolidation(nil), cfs...)
+	return func(db *Db) {
+		db.cfs = cfs
+	}
+}
+
+// checkConsolidations returns an error unless cfs is a valid set of
+// consolidation functions for a database.
+func checkConsolidations(cfs []Consolidation) error {
+	if len(cfs) == 0 {
+		return errors.New("goaround: no consolidation functions given")
+	}
+	for i, cf := range cfs {
+		if cf < 0 || int(cf) >= len(consolidationNames) {
+			return errors.New("goaround: unknown consolidation function")
+		}
+		for _, other := range cfs[:i] {
+			if cf == other {
+				return errors.New("goaround: duplicate consolidation function")
+			}
+		}
+	}
+	return nil
+}
+
+// start returns the value of a timebox whose first sample is v, representing
+// amount.
+func (cf Consolidation) start(v, amount float32) float32 {
+	switch cf {
+	case Sum:
+		return amount
+	case Count:
+		return 1
+	}
+	return v
+}
+
+// update returns the new value of a timebox currently holding old, which
+// covers prevFill seconds, after applying v (representing amount) for a
+// further curDuration seconds. If sample is false, v belongs to a later
+// timebox and is only being applied to the remainder of this one, which
+// affects the time-weighted Average but none of the functions that consider
+// individual samples.
+func (cf Consolidation) update(old, v, amount, prevFill, curDuration float32, sample bool) float32 {
+	// A timebox holding no data yet takes v as its first data
+	if IsUnknown(old) {
+		if sample {
+			return cf.start(v, amount)
+		}
+		if cf == Average {
+			return v
+		}
+		return old
+	}
+
+	switch cf {
+	case Average:
+		if prevFill+curDuration == 0 {
+			if sample {
+				return v
+			}
+			return old
+		}
+		return (old*prevFill + v*curDuration) / (prevFill + curDuration)
+	}
+
+	if !sample {
+		return old
+	}
+
+	switch cf {
+	case Min:
+		if v < old {
+			return v
+		}
+		return old
+	case Max:
+		if v > old {
+			return v
+		}
+		return old
+	case Last:
+		return v
+	case Sum:
+		return old + amount
+	case Count:
+		return old + 1
+	}
+
+	panic("Unknown consolidation function.")
+}
+
+// merge returns the new value of a timebox currently holding old, which covers
+// prevFill seconds, after rolling in v, the value this same function gave a
+// finer timebox covering a further curDuration seconds.
+func (cf Consolidation) merge(old, v, prevFill, curDuration float32) float32 {
+	if IsUnknown(v) {
+		return old
+	}
+	if IsUnknown(old) {
+		return v
+	}
+
+	switch cf {
+	case Average:
+		if prevFill+curDuration == 0 {
+			return v
+		}
+		return (old*prevFill + v*curDuration) / (prevFill + curDuration)
+	case Min:
+		if v < old {
+			return v
+		}
+		return old
+	case Max:
+		if v > old {
+			return v
+		}
+		return old
+	case Last:
+		return v
+	case Sum, Count:
+		return old + v
+	}
+
+	panic("Unknown consolidation function.")
+}
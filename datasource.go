@@ -0,0 +1,135 @@
+/*
+ * File:	datasource.go
+ *
+ * Implements the data source kinds, which convert raw readings (such as the
+ * value of an ever-increasing counter) into the values stored in a database.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import "fmt"
+import "math"
+import "time"
+
+// DataSource identifies how the raw readings given to AddAt are turned into
+// the values that get consolidated into timeboxes, following rrdtool's data
+// source types. Except for Gauge, each reading is turned into a per-second
+// rate over the time since the previous reading, so the first reading only
+// establishes a starting point and records no data.
+type DataSource int
+
+const (
+	// Gauge readings are stored as-is, e.g. temperatures or queue lengths.
+	Gauge DataSource = iota
+
+	// Counter readings come from a counter that only ever increases, e.g.
+	// the bytes sent on an interface, and are whole numbers; use
+	// AddCounterAt to pass them without loss of precision. A reading lower
+	// than the previous one is taken to mean the counter wrapped around: at
+	// 2^32 if the previous reading fit in 32 bits, otherwise at 2^64.
+	Counter
+
+	// Derive readings are like Counter, but a decrease is taken at face
+	// value and yields a negative rate.
+	Derive
+
+	// Absolute readings are the amount counted since the previous reading,
+	// e.g. from a counter that is reset every time it's read.
+	Absolute
+)
+
+var dataSourceNames = []string{"GAUGE", "COUNTER", "DERIVE", "ABSOLUTE"}
+
+func (ds DataSource) String() string {
+	if ds < 0 || int(ds) >= len(dataSourceNames) {
+		return fmt.Sprintf("DataSource(%d)", int(ds))
+	}
+	return dataSourceNames[ds]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, giving the
+// data source's name as returned by String.
+func (ds DataSource) MarshalText() ([]byte, error) {
+	if ds < 0 || int(ds) >= len(dataSourceNames) {
+		return nil, fmt.Errorf("goaround: unknown data source %d", int(ds))
+	}
+	return []byte(dataSourceNames[ds]), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, accepting
+// the names returned by String.
+func (ds *DataSource) UnmarshalText(b []byte) error {
+	for i, name := range dataSourceNames {
+		if string(b) == name {
+			*ds = DataSource(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("goaround: unknown data source %q", b)
+}
+
+// WithDataSource configures the kind of data source the database records.
+// Without this option a database records a Gauge.
+func WithDataSource(ds DataSource) Option {
+	if ds < 0 || int(ds) >= len(dataSourceNames) {
+		panic("Unknown data source.")
+	}
+	return func(db *Db) {
+		db.kind = ds
+	}
+}
+
+// convert turns reading cur, taken elapsed after reading prev, into the value
+// to consolidate and the amount it represents: the reading itself for a Gauge,
+// otherwise the per-second rate and the total increase since prev. Counters
+// are computed from the exact integer readings prevCount and curCount, the
+// others from the floating point readings.
+func (ds DataSource) convert(prev float64, prevCount uint64, cur float64, curCount uint64,
+	elapsed time.Duration) (v, amount float32) {
+
+	var diff float64
+	switch ds {
+	case Gauge:
+		return float32(cur), float32(cur)
+	case Counter:
+		// Unsigned subtraction takes care of wrapping at 2^64
+		d := curCount - prevCount
+		if curCount < prevCount && prevCount <= math.MaxUint32 {
+			d = uint64(uint32(curCount) - uint32(prevCount))
+		}
+		diff = float64(d)
+	case Derive:
+		diff = cur - prev
+	case Absolute:
+		diff = cur
+	default:
+		panic("Unknown data source.")
+	}
+
+	return float32(diff / elapsed.Seconds()), float32(diff)
+}
@@ -0,0 +1,95 @@
+/*
+ * File:	datasource_test.go
+ *
+ * Implements tests for the datasource.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDataSources(t *testing.T) {
+	var tests = []struct {
+		kind     DataSource
+		readings []uint64 // taken 10 seconds apart
+		rates    []float32
+	}{
+		{Counter, []uint64{100, 200, 450}, []float32{10, 25}},
+		{Counter, []uint64{1<<32 - 50, 50}, []float32{10}},
+		{Counter, []uint64{1<<64 - 1024, 1024}, []float32{204.8}},
+		{Derive, []uint64{300, 200}, []float32{-10}},
+		{Absolute, []uint64{100, 200}, []float32{20}},
+	}
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i, tt := range tests {
+		// Keep everything in one timebox and look at the latest rate
+		db := New(3600*time.Second, 10, WithDataSource(tt.kind), WithConsolidation(Last))
+		for j, r := range tt.readings {
+			if err := db.AddCounterAt(r, base.Add(time.Duration(j*10)*time.Second)); err != nil {
+				t.Fatalf("Test %d: db.AddCounterAt returned %v", i, err)
+			}
+
+			x := db.Get(0)
+			if j == 0 && !IsUnknown(x) {
+				t.Errorf("Test %d: first reading gave %v, expected unknown", i, x)
+			}
+			if j > 0 && x != tt.rates[j-1] {
+				t.Errorf("Test %d: reading %d gave %v, expected %v", i, j, x, tt.rates[j-1])
+			}
+		}
+	}
+}
+
+func TestCounterConsolidation(t *testing.T) {
+	db := New(60*time.Second, 10, WithDataSource(Counter), WithConsolidation(Average, Sum))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	readings := []uint64{1000, 1100, 1400, 1500}
+	for i, r := range readings {
+		db.AddCounterAt(r, base.Add(time.Duration(i*20)*time.Second))
+	}
+
+	// First timebox: 5/s, 15/s, then 5/s for 20s each
+	if x, want := db.Get(0), float32(500)/60; x != want {
+		t.Errorf("db.Get(0) = %v, want %v", x, want)
+	}
+	if x := db.GetCF(0, Sum); x != 400 {
+		t.Errorf("db.GetCF(0, Sum) = %v, want 400", x)
+	}
+	if x := db.GetCF(1, Sum); x != 100 {
+		t.Errorf("db.GetCF(1, Sum) = %v, want 100", x)
+	}
+
+	if err := db.AddCounterAt(1600, base.Add(60*time.Second)); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("repeated timestamp returned %v, expected ErrOutOfOrder", err)
+	}
+}
@@ -31,141 +31,525 @@
 
 package goaround
 
+import "errors"
 import "fmt"
+import "math"
+import "sync"
 import "time"
 
+// Errors returned by AddAt (and Add) when a sample is rejected. The database
+// is left unchanged whenever one of these is returned.
+var (
+	// ErrOutOfOrder indicates the sample is older than the most recent
+	// update to the database.
+	ErrOutOfOrder = errors.New("goaround: sample is older than the last update")
+
+	// ErrBeforeRetention indicates the sample is so old that it falls before
+	// the oldest timebox the database is able to hold.
+	ErrBeforeRetention = errors.New("goaround: sample is before the retained window")
+
+	// ErrInvalidValue indicates the sample value is NaN or infinite.
+	ErrInvalidValue = errors.New("goaround: sample value is NaN or infinite")
+)
+
+// Point is a single timebox of data returned by Fetch.
+type Point struct {
+	Time    time.Time // start of the timebox, in UTC
+	Value   float32   // consolidated value of the timebox
+	Missing bool      // true if there is no data for the timebox (Value is NaN)
+}
+
+// unknown is stored in entries for timeboxes with no data.
+var unknown = float32(math.NaN())
+
+// IsUnknown reports whether v, a value returned by Get, marks a timebox for
+// which the database has no data.
+func IsUnknown(v float32) bool {
+	return v != v
+}
+
+// A Db is safe for concurrent use by multiple goroutines. Samples are added
+// one at a time, and readers see the database either before or after any
+// given sample is applied. For a consistent view across several reads, take a
+// Snapshot.
 type Db struct {
-	res          int       // resolution - how many seconds elapse between successive entries
-	entries      []float32 // the individual database entries
-	head         int       // index of the beginning of the list. -1 means no data.
-	tail         int       // index of the end of the list. -1 means no data.
-	currentStart time.Time // beginning time of current bucket
-	currentStop  time.Time // end time of current bucket
-	lastEntry    time.Time // last update time
-}
-
-// New creates and returns a new Db with the specified resolution (in seconds)
-// and capacity.
-func New(resolution int, capacity int) *Db {
+	mu           sync.RWMutex    // guards everything below
+	boxing                       // how time is divided into timeboxes: the resolution and alignment
+	cfs          []Consolidation // consolidation functions kept for each timebox
+	kind         DataSource      // how raw readings are converted to values
+	entries      []float32       // the individual database entries, len(cfs) per timebox
+	head         int             // index of the beginning of the list. -1 means no data.
+	tail         int             // index of the end of the list. -1 means no data.
+	currentStart time.Time       // beginning time of current bucket
+	currentStop  time.Time       // end time of current bucket
+	lastEntry    time.Time       // last update time
+	lastRaw      float64         // raw reading of the last update
+	lastCount    uint64          // raw reading of the last update, as an exact integer
+	heartbeat    time.Duration   // longest gap between samples that is still known data
+	xff          float64         // fraction of a timebox that may be unknown
+	unknownTime  time.Duration   // time between currentStart and lastEntry with no data
+	moves        int             // number of times the tail has moved forward
+	updates      uint64          // number of changes made, so savers can tell what changed
+	compress     bool            // whether GobEncode compresses the entries
+	file         *dbFile         // file the database is kept in, if any
+	wal          *WAL            // write-ahead log of accepted samples, if any
+	clock        Clock           // tells the time for Add and AddCounter; nil for the system clock
+}
+
+// An Option configures optional behavior of a Db when passed to New.
+type Option func(*Db)
+
+// WithXFF configures the xfiles factor of the database: the fraction of a
+// timebox that may be unknown before the whole timebox is reported unknown.
+// It is applied to each timebox as the database moves on from it, so the
+// timebox currently being filled may still hold a value based on only a small
+// part of its time.
+func WithXFF(xff float64) Option {
+	if !(xff >= 0 && xff <= 1) {
+		panic("XFF must be between 0 and 1.")
+	}
+	return func(db *Db) {
+		db.xff = xff
+	}
+}
+
+// WithLocation configures the database to align its timeboxes to the wall
+// clock of loc, rather than of UTC, so that, for example, daily timeboxes
+// start at local midnight. Timeboxes then follow the clock across changes for
+// daylight saving time, so a daily timebox may be 23 or 25 hours long. The
+// location is saved with the database by name, so it must be one
+// time.LoadLocation can load for the database to be loaded again, and, for a
+// database kept in a file (see Create), no more than 56 bytes long.
+func WithLocation(loc *time.Location) Option {
+	if loc == nil {
+		panic("Nil location.")
+	}
+	return func(db *Db) {
+		db.loc = loc
+		if loc == time.UTC {
+			db.loc = nil
+		}
+	}
+}
+
+// WithOffset configures the database to shift its timeboxes by offset from
+// their usual alignment, so that, for example, daily timeboxes with an offset
+// of six hours start at 6am. The offset applies to the wall clock configured
+// by WithLocation.
+func WithOffset(offset time.Duration) Option {
+	return func(db *Db) {
+		db.offset = offset
+	}
+}
+
+// WithHeartbeat configures the heartbeat of the database: the longest time
+// that may pass between two samples before the time between them is treated
+// as unknown rather than interpolated. A heartbeat of zero means none.
+func WithHeartbeat(heartbeat time.Duration) Option {
+	if heartbeat < 0 {
+		panic("Negative heartbeat.")
+	}
+	return func(db *Db) {
+		db.heartbeat = heartbeat
+	}
+}
+
+// New creates and returns a new Db with the specified resolution, which may be
+// as fine as a nanosecond, and capacity. Without options, samples are treated
+// as a Gauge, consolidated with Average, there is no heartbeat, and timeboxes
+// are never made unknown for being only partly known (an xfiles factor of 1).
+func New(resolution time.Duration, capacity int, opts ...Option) *Db {
+	if resolution <= 0 {
+		panic("Resolution must be positive.")
+	}
+	return newDb(boxing{res: resolution}, capacity, opts)
+}
+
+// newDb implements New and NewCalendar, creating a database that divides time
+// into timeboxes as b does.
+func newDb(b boxing, capacity int, opts []Option) *Db {
 	db := new(Db)
-	db.res = resolution
-	db.entries = make([]float32, capacity)
+	db.boxing = b
+	db.cfs = []Consolidation{Average}
+	db.xff = 1
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.res > 0 {
+		db.offset = (db.offset%db.res + db.res) % db.res
+	}
+	db.entries = make([]float32, capacity*len(db.cfs))
 	db.head = -1
 	db.tail = -1
 	return db
 }
 
-// Res returns the resolution of the database.
-func (db *Db) Res() int {
+// Res returns the resolution of the database, or zero for a database created
+// by NewCalendar, whose timeboxes vary in length.
+func (db *Db) Res() time.Duration {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.res
 }
 
+// Location returns the location whose wall clock the database's timeboxes are
+// aligned to.
+func (db *Db) Location() *time.Location {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.location()
+}
+
+// Offset returns how far the database's timeboxes are shifted from their usual
+// alignment: between zero and the resolution, or as given to WithOffset for a
+// database created by NewCalendar.
+func (db *Db) Offset() time.Duration {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.offset
+}
+
 // Capacity returns the capacity of the database.
 func (db *Db) Capacity() int {
-	return len(db.entries)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.capacity()
+}
+
+func (db *Db) capacity() int {
+	return len(db.entries) / len(db.cfs)
+}
+
+// Consolidations returns the consolidation functions kept by the database, in
+// the order given to WithConsolidation. The first is the one used by Get and
+// Fetch.
+func (db *Db) Consolidations() []Consolidation {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]Consolidation(nil), db.cfs...)
+}
+
+// Heartbeat returns the heartbeat the database was created with, or zero if
+// it has none.
+func (db *Db) Heartbeat() time.Duration {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.heartbeat
+}
+
+// XFF returns the xfiles factor the database was created with.
+func (db *Db) XFF() float64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.xff
 }
 
-// Add will add value v to the database at the current time.
-func (db *Db) Add(v float32) {
-	db.AddAt(v, time.Now())
+// DataSource returns the kind of data source the database was created with.
+func (db *Db) DataSource() DataSource {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.kind
+}
+
+// Snapshot returns a copy of the database. The copy is independent of the
+// original, so it can be read at leisure without holding up samples being
+// added to the original.
+func (db *Db) Snapshot() *Db {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.snapshot()
+}
+
+// snapshot implements Snapshot, for a caller holding db.mu.
+func (db *Db) snapshot() *Db {
+	c := &Db{
+		boxing:       db.boxing,
+		cfs:          db.cfs,
+		kind:         db.kind,
+		entries:      append([]float32(nil), db.entries...),
+		head:         db.head,
+		tail:         db.tail,
+		currentStart: db.currentStart,
+		currentStop:  db.currentStop,
+		lastEntry:    db.lastEntry,
+		lastRaw:      db.lastRaw,
+		lastCount:    db.lastCount,
+		heartbeat:    db.heartbeat,
+		xff:          db.xff,
+		unknownTime:  db.unknownTime,
+		compress:     db.compress,
+		clock:        db.clock,
+	}
+	return c
+}
+
+// Add will add value v to the database at the current time, as told by its
+// clock (see WithClock).
+func (db *Db) Add(v float32) error {
+	return db.AddAt(v, db.clockOrSystem().Now())
 }
 
 // AddAt will add a value, v, to the database at the specific time, t. Data will
-// be consolidated (averaged) correctly to apply data with any timestamp into
-// the defined timeboxes of the database.
-func (db *Db) AddAt(v float32, t time.Time) {
+// be converted according to the database's DataSource and then consolidated
+// correctly, according to each of the database's consolidation functions, to
+// apply data with any timestamp into the defined timeboxes of the database.
+//
+// Each sample's value applies to the time since the previous sample. If the
+// database has a heartbeat and the samples are further apart than that, the
+// time between them is unknown instead. Without a heartbeat, a sample's value
+// only reaches back as far as the start of the timebox before its own.
+//
+// If the sample can't be applied, AddAt returns ErrInvalidValue,
+// ErrOutOfOrder or ErrBeforeRetention (test with errors.Is) and the database
+// is not modified. For a database kept in a file (see Open) or with a
+// write-ahead log (see SetWAL), AddAt also returns any error writing the
+// sample to them, in which case the database in memory has been updated but
+// the file or log may not have been.
+func (db *Db) AddAt(v float32, t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.add(float64(v), uint64(math.Max(0, float64(v))), t, true)
+}
+
+// AddCounter will add the counter reading v to the database at the current
+// time, as told by its clock (see WithClock).
+func (db *Db) AddCounter(v uint64) error {
+	return db.AddCounterAt(v, db.clockOrSystem().Now())
+}
+
+// AddCounterAt is like AddAt, but takes an integer reading, which keeps far
+// more precision than a float32 for the large values typical of a Counter
+// data source.
+func (db *Db) AddCounterAt(v uint64, t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.add(float64(v), v, t, true)
+}
+
+// add applies a raw reading with addAt, appends it to the database's
+// write-ahead log if it has one and log is set, then writes the changes
+// through to the database's file, if it has one.
+func (db *Db) add(raw float64, count uint64, t time.Time, log bool) error {
+	if log && db.wal != nil {
+		if err := checkWALTime(t); err != nil {
+			return err
+		}
+	}
+	oldTail, oldMoves := db.tail, db.moves
+	if err := db.addAt(raw, count, t); err != nil {
+		return err
+	}
+	db.updates++
+	if log && db.wal != nil {
+		if err := db.wal.append("", raw, count, t); err != nil {
+			return err
+		}
+	}
+	if db.file != nil {
+		return db.file.update(db, oldTail, db.moves-oldMoves)
+	}
+	return nil
+}
+
+// addAt implements AddAt for a raw reading, given both as raw and, for a
+// Counter, as the exact integer count.
+func (db *Db) addAt(raw float64, count uint64, t time.Time) error {
+	if err := db.check(raw, t); err != nil {
+		return err
+	}
+
 	// Normalize everything to UTC
 	t = t.UTC()
 
 	// t0 and t1 is the time box that this data point should live in
-	t0, t1 := BoxTime(t, db.res)
-	t0, t1 = t0.UTC(), t1.UTC()
+	t0, t1 := db.boxTime(t)
 
 	// Check if database is empty. If so, create the first entry.
 	if db.tail == -1 {
 		db.tail = 0
 		db.head = 0
-		db.entries[db.tail] = v
 		db.currentStart = t0
 		db.currentStop = t1
+		if db.kind == Gauge {
+			db.startBox(float32(raw), float32(raw))
+		} else {
+			// A rate needs two readings, so there's no data yet
+			db.clearBox()
+			db.unknownTime = t.Sub(t0)
+		}
 		db.lastEntry = t
-		return
+		db.lastRaw, db.lastCount = raw, count
+		return nil
 	}
 
-	// Are we trying to rewrite history?
-	if t.Before(db.lastEntry) {
-		// TODO: real error handling
-		fmt.Println("Can't rewrite history.")
-		return
-	}
+	elapsed := t.Sub(db.lastEntry)
+	v, amount := db.kind.convert(db.lastRaw, db.lastCount, raw, count, elapsed)
+	db.lastRaw, db.lastCount = raw, count
 
-	// Are we still in tail's timebox?
-	if t.Before(db.currentStop) {
-		prevFill := float32(db.lastEntry.Sub(db.currentStart).Seconds())
-		curDuration := float32(t.Sub(db.lastEntry).Seconds())
-		oldval := db.entries[db.tail]
-		newval := (oldval*prevFill + v*curDuration) / (prevFill + curDuration)
-		db.entries[db.tail] = newval
-		db.lastEntry = t
-		return
+	// The sample covers the time since the last update. Work out when the
+	// known part of that begins: if the sample is stale (it came after
+	// longer than the heartbeat) none of it is known and the sample just
+	// serves as the starting point for the next one. Without a heartbeat,
+	// a sample only reaches back into the timebox before its own, and any
+	// timeboxes skipped over entirely are unknown.
+	knownFrom := db.lastEntry
+	stale := db.heartbeat > 0 && elapsed > db.heartbeat
+	if stale {
+		knownFrom = t
+	} else if db.heartbeat == 0 {
+		if _, next := db.boxTime(db.currentStop); !t.Before(next) {
+			knownFrom = t0
+		}
 	}
 
-	// Have we moved exactly one timebox forward?
-	if temp := db.currentStop.Add(time.Duration(db.res) * time.Second); t.Before(temp) {
-		// First we need to apply whatever was left in the previous timebox
-		prevFill := float32(db.lastEntry.Sub(db.currentStart).Seconds())
-		curDuration := float32(db.currentStop.Sub(db.lastEntry).Seconds())
-		oldval := db.entries[db.tail]
-		newval := (oldval*prevFill + v*curDuration) / (prevFill + curDuration)
-		db.entries[db.tail] = newval
+	// Apply the sample to each timebox from the tail up to the one t lives
+	// in, moving the tail forward as we go. Only the final timebox gets the
+	// sample itself; the ones before it are just filled in.
+	for {
+		final := t.Before(db.currentStop)
+		end := db.currentStop
+		if final {
+			end = t
+		}
+
+		from := db.lastEntry
+		if knownFrom.After(from) {
+			from = knownFrom
+			if from.After(end) {
+				from = end
+			}
+		}
+		db.unknownTime += from.Sub(db.lastEntry)
+
+		if !stale && (end.After(from) || final) {
+			prevFill := float32(db.known().Seconds())
+			curDuration := float32(end.Sub(from).Seconds())
+			db.updateBox(v, amount, prevFill, curDuration, final)
+		}
+		db.lastEntry = end
+
+		if final {
+			return nil
+		}
 
 		// Move the tail (which also updates the start and stop times)
 		db.moveForward()
+	}
+}
 
-		// Apply reading to current (new) timebox/tail
-		db.entries[db.tail] = v
-		db.lastEntry = t
+// check returns the error AddAt would return for raw reading v at time t, if
+// any.
+func (db *Db) check(v float64, t time.Time) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ErrInvalidValue
+	}
 
-		return
-	} else {
-		// We've gone more than one timebox forward
-		// Catch up to where we should be, filling in zeros in the missing slots
-		for db.currentStop.Before(t) {
-			db.moveForward()
-			db.entries[db.tail] = 0
+	if db.tail == -1 {
+		return nil
+	}
+
+	// Are we trying to rewrite history? Rates can't be computed over no
+	// time at all, so those also need t to be strictly after the last update.
+	if t.Before(db.lastEntry) || (db.kind != Gauge && t.Equal(db.lastEntry)) {
+		if t.Before(db.retained()) {
+			return ErrBeforeRetention
 		}
+		return ErrOutOfOrder
+	}
 
-		// Apply reading to current timebox/tail
-		db.entries[db.tail] = v
-		db.lastEntry = t
+	return nil
+}
+
+// known returns how much of the tail timebox, up to the last update, is
+// covered by data.
+func (db *Db) known() time.Duration {
+	return db.lastEntry.Sub(db.currentStart) - db.unknownTime
+}
+
+// box returns the entries (one per consolidation function) of the timebox at
+// position slot of the ring.
+func (db *Db) box(slot int) []float32 {
+	n := len(db.cfs)
+	return db.entries[slot*n : slot*n+n]
+}
+
+// startBox initializes the tail timebox with its first sample, v, which
+// represents amount (see DataSource).
+func (db *Db) startBox(v, amount float32) {
+	for k, cf := range db.cfs {
+		db.box(db.tail)[k] = cf.start(v, amount)
+	}
+}
+
+// updateBox applies sample v, representing amount, to the tail timebox, which
+// already holds data covering prevFill seconds, with v covering a further
+// curDuration seconds. If sample is false, v belongs to a later timebox and
+// only fills in the remainder of this one; it is not counted as a sample
+// within the timebox.
+func (db *Db) updateBox(v, amount, prevFill, curDuration float32, sample bool) {
+	for k, cf := range db.cfs {
+		e := &db.box(db.tail)[k]
+		*e = cf.update(*e, v, amount, prevFill, curDuration, sample)
+	}
+}
+
+// clearBox marks every entry of the tail timebox unknown.
+func (db *Db) clearBox() {
+	for k := range db.cfs {
+		db.box(db.tail)[k] = unknown
 	}
 }
 
 // moveForward will increment the tail (and head if necessary) by one position
-// and update the currentStart and currentStop time for the new timebox
+// and update the currentStart and currentStop time for the new timebox, which
+// starts out empty.
 func (db *Db) moveForward() {
+	db.finishBox()
+	db.moves++
+
+	capacity := db.capacity()
+
 	db.tail++
-	if db.tail >= len(db.entries) {
+	if db.tail >= capacity {
 		db.tail = 0
 	}
 
 	if db.tail == db.head {
 		db.head++
-		if db.head >= len(db.entries) {
+		if db.head >= capacity {
 			db.head = 0
 		}
 	}
 
-	// Update times. Running through BoxTime() instead of directly adding
-	// seconds so that floating point errors don't accumulate over time
-	newTime := db.currentStop.Add(time.Duration(1) * time.Second)
-	db.currentStart, db.currentStop = BoxTime(newTime, db.res)
+	// Update times. The timebox after the tail is the one its stop time
+	// falls in.
+	db.currentStart, db.currentStop = db.boxTime(db.currentStop)
+
+	db.clearBox()
+	db.lastEntry = db.currentStart
+	db.unknownTime = 0
+}
+
+// finishBox applies the xfiles factor to the tail timebox, which the database
+// is about to move on from.
+func (db *Db) finishBox() {
+	length := db.currentStop.Sub(db.currentStart)
+	unknownTime := db.unknownTime + db.currentStop.Sub(db.lastEntry)
+	if float64(unknownTime) > db.xff*float64(length) {
+		db.clearBox()
+	}
 }
 
 // Len returns the length of actual data in the database [e.g. a database with
 // a large capacity but not yet filled could have Len() < Capacity(), but Len()
 // will never be greater than Capacity()].
 func (db *Db) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.length()
+}
+
+func (db *Db) length() int {
 	if db.tail == -1 {
 		return 0
 	}
@@ -175,40 +559,128 @@ func (db *Db) Len() int {
 	}
 
 	if db.head > db.tail {
-		return len(db.entries) - db.head + db.tail + 1
+		return db.capacity() - db.head + db.tail + 1
 	}
 
 	panic("It shouldn't be possible to get here.")
 }
 
-// Get returns the value at the indicated index. Index must not be outside the
+// Get returns the value at the indicated index, as consolidated by the
+// database's first consolidation function. Index must not be outside the
 // bounds of the current populated data [i.e. index must be less than Len(),
-// even if Capacity() > Len()].
+// even if Capacity() > Len()]. Timeboxes that were skipped over without
+// receiving any data hold an unknown value (NaN); check with IsUnknown.
 func (db *Db) Get(i int) float32 {
-	if i >= db.Len() {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.box(db.slot(i))[0]
+}
+
+// GetCF is like Get, but returns the value consolidated by cf, which must be
+// one of the database's consolidation functions.
+func (db *Db) GetCF(i int, cf Consolidation) float32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.box(db.slot(i))[db.cfIndex(cf)]
+}
+
+// slot converts index i, counted from the head, to a position in the ring.
+func (db *Db) slot(i int) int {
+	if i < 0 || i >= db.length() {
 		panic("Index out of bounds.")
 	}
 
-	if db.head <= db.tail {
-		return db.entries[db.head+i]
+	j := db.head + i
+	if capacity := db.capacity(); j >= capacity {
+		j -= capacity
 	}
+	return j
+}
 
-	if db.head > db.tail {
-		j := db.head + i
-		if j < len(db.entries) {
-			return db.entries[j]
-		} else {
-			return db.entries[j-len(db.entries)]
+// cfIndex returns the position of cf among the database's consolidation
+// functions.
+func (db *Db) cfIndex(cf Consolidation) int {
+	for k, c := range db.cfs {
+		if c == cf {
+			return k
 		}
 	}
+	panic("Consolidation function not kept by database.")
+}
 
-	panic("It shouldn't be possible to get here.")
+// Fetch returns one Point for each timebox that overlaps the range from start
+// (inclusive) to end (exclusive), in chronological order, as consolidated by
+// the database's first consolidation function. The range is clipped to the
+// window of time the database is able to retain; timeboxes within that window
+// for which there is no data, or whose value is unknown, are returned with
+// Missing set. If the database is empty or the range doesn't overlap the
+// window, Fetch returns nil.
+func (db *Db) Fetch(start, end time.Time) []Point {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.fetch(0, start, end)
+}
+
+// FetchCF is like Fetch, but returns values consolidated by cf, which must be
+// one of the database's consolidation functions.
+func (db *Db) FetchCF(cf Consolidation, start, end time.Time) []Point {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.fetch(db.cfIndex(cf), start, end)
+}
+
+// fetch implements Fetch for the k'th consolidation function.
+func (db *Db) fetch(k int, start, end time.Time) []Point {
+	if db.tail == -1 {
+		return nil
+	}
+
+	if retained := db.retained(); start.Before(retained) {
+		start = retained
+	}
+	if end.After(db.currentStop) {
+		end = db.currentStop
+	}
+	if !start.Before(end) {
+		return nil
+	}
+
+	first := db.oldest()
+
+	var points []Point
+	t, _ := db.boxTime(start)
+	i := 0
+	if !t.Before(first) {
+		i = db.count(first, t)
+	}
+	for ; t.Before(end); t = db.step(t, 1) {
+		p := Point{Time: t, Value: unknown}
+		if !t.Before(first) {
+			p.Value = db.box(db.slot(i))[k]
+			i++
+		}
+		p.Missing = IsUnknown(p.Value)
+		points = append(points, p)
+	}
+
+	return points
+}
+
+// retained returns the start of the window of time the database is able to
+// hold, which ends with the tail timebox.
+func (db *Db) retained() time.Time {
+	return db.step(db.currentStop, -db.capacity())
+}
+
+// oldest returns the start time of the timebox held at index 0 (the head).
+func (db *Db) oldest() time.Time {
+	return db.step(db.currentStart, 1-db.length())
 }
 
 func (db *Db) printDebug() {
 	fmt.Println("---- DB Dump ------------------------------")
 	fmt.Printf("res: %v, head: %v, tail: %v ", db.res, db.head, db.tail)
-	fmt.Printf("cap: %v, len: %v\n", len(db.entries), db.Len())
+	fmt.Printf("cap: %v, len: %v, cfs: %v\n", db.capacity(), db.length(), db.cfs)
 	fmt.Printf("start: %v, stop: %v\n", db.currentStart.UTC(), db.currentStop.UTC())
 	fmt.Printf("last: %v\n", db.lastEntry.UTC())
 	fmt.Printf("data: %v\n", db.entries)
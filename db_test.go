@@ -31,11 +31,15 @@
 
 package goaround
 
+import "errors"
+import "math"
+import "path/filepath"
+import "sync"
 import "testing"
 import "time"
 
 func TestCreation(t *testing.T) {
-	res := 5
+	res := 5 * time.Second
 	capacity := 27
 	db := New(res, capacity)
 
@@ -53,7 +57,7 @@ func TestCreation(t *testing.T) {
 }
 
 func TestSimplePopulation(t *testing.T) {
-	res := 5
+	res := 5 * time.Second
 	capacity := 10
 	db := New(res, capacity)
 
@@ -97,15 +101,15 @@ func TestComplexPopulation(t *testing.T) {
 		{1, 12.5},
 		{2, 30.166666667},
 		{3, 10},
-		{4, 0},
-		{5, 0},
+		{4, unknown},
+		{5, unknown},
 		{6, 28.666666667},
 		{7, 30},
 		{8, 21.666666667},
 		{9, 20},
 	}
 
-	res := 30
+	res := 30 * time.Second
 	capacity := 10
 	db := New(res, capacity)
 
@@ -115,8 +119,393 @@ func TestComplexPopulation(t *testing.T) {
 	}
 
 	for _, v := range expectedResults {
-		if result := db.Get(v.i); result != v.v {
+		if result := db.Get(v.i); !sameValue(result, v.v) {
 			t.Errorf("db.Get(%d) returned %v, expected %v", v.i, result, v.v)
 		}
 	}
 }
+
+// This test exercises timeboxes shorter than a second
+func TestSubSecondPopulation(t *testing.T) {
+	db := New(250*time.Millisecond, 8)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:01Z")
+	for i, v := range []float32{5, 5, 10, 20, 20, 40} {
+		db.AddAt(v, base.Add(time.Duration(i)*100*time.Millisecond))
+	}
+
+	// Samples at 0.1s intervals; the last reaches halfway into the third box
+	expected := []float32{(5*100 + 10*100 + 20*50) / 250, (20*50 + 20*100 + 40*100) / 250, 40}
+	if db.Len() != len(expected) {
+		t.Fatalf("db.Len() = %v, want %v", db.Len(), len(expected))
+	}
+	for i, want := range expected {
+		if x := db.Get(i); !sameValue(x, want) {
+			t.Errorf("db.Get(%d) returned %v, expected %v", i, x, want)
+		}
+	}
+
+	points := db.Fetch(base, base.Add(time.Second))
+	if len(points) != 3 || !points[1].Time.Equal(base.Add(250*time.Millisecond)) {
+		t.Errorf("db.Fetch returned %v", points)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	db := New(30*time.Second, 4)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:01Z")
+	if err := db.AddAt(1, base); err != nil {
+		t.Fatalf("db.AddAt returned %v on empty database", err)
+	}
+	if err := db.AddAt(2, base.Add(5*time.Minute)); err != nil {
+		t.Fatalf("db.AddAt returned %v", err)
+	}
+
+	var tests = []struct {
+		v    float32
+		t    time.Time
+		want error
+	}{
+		{float32(math.NaN()), base.Add(6 * time.Minute), ErrInvalidValue},
+		{float32(math.Inf(1)), base.Add(6 * time.Minute), ErrInvalidValue},
+		{3, base.Add(4 * time.Minute), ErrOutOfOrder},
+		{3, base, ErrBeforeRetention},
+	}
+
+	for i, tt := range tests {
+		if err := db.AddAt(tt.v, tt.t); !errors.Is(err, tt.want) {
+			t.Errorf("Test %d: db.AddAt returned %v, expected %v", i, err, tt.want)
+		}
+	}
+
+	if x := db.Get(db.Len() - 1); x != 2 {
+		t.Errorf("rejected samples changed the database: got %v, expected 2", x)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	db := New(30*time.Second, 4)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:00Z")
+	db.AddAt(1, base.Add(10*time.Second))
+	db.AddAt(2, base.Add(40*time.Second))
+
+	var tests = []struct {
+		start, end time.Duration // offsets from base
+		times      []time.Duration
+		missing    []bool
+		values     []float32
+	}{
+		// Range extends before the retained window and after the last box
+		{-time.Hour, time.Hour,
+			[]time.Duration{-60 * time.Second, -30 * time.Second, 0, 30 * time.Second},
+			[]bool{true, true, false, false},
+			[]float32{unknown, unknown, 5.0 / 3, 2}},
+		// Unaligned range within the data
+		{15 * time.Second, 31 * time.Second,
+			[]time.Duration{0, 30 * time.Second},
+			[]bool{false, false},
+			[]float32{5.0 / 3, 2}},
+		// Range after the data
+		{2 * time.Minute, time.Hour, nil, nil, nil},
+	}
+
+	for i, tt := range tests {
+		points := db.Fetch(base.Add(tt.start), base.Add(tt.end))
+		if len(points) != len(tt.times) {
+			t.Errorf("Test %d: got %d points, expected %d", i, len(points), len(tt.times))
+			continue
+		}
+		for j, p := range points {
+			if want := base.Add(tt.times[j]); !p.Time.Equal(want) {
+				t.Errorf("Test %d: point %d has time %v, expected %v", i, j, p.Time, want)
+			}
+			if p.Missing != tt.missing[j] || !sameValue(p.Value, tt.values[j]) {
+				t.Errorf("Test %d: point %d is (%v, missing=%v), expected (%v, missing=%v)",
+					i, j, p.Value, p.Missing, tt.values[j], tt.missing[j])
+			}
+		}
+	}
+}
+
+// sameValue compares two database values, treating unknown values as equal.
+func sameValue(a, b float32) bool {
+	return a == b || (IsUnknown(a) && IsUnknown(b))
+}
+
+func TestConsolidation(t *testing.T) {
+	var data = []struct {
+		t string
+		v float32
+	}{
+		{"2013-01-01T08:10:00Z", 4},
+		{"2013-01-01T08:10:10Z", 1},
+		{"2013-01-01T08:10:20Z", 7},
+		{"2013-01-01T08:10:40Z", 2},
+		{"2013-01-01T08:11:50Z", 3},
+	}
+
+	cfs := []Consolidation{Average, Min, Max, Last, Sum, Count}
+	var expected = [][]float32{
+		// AVERAGE, MIN, MAX, LAST, SUM, COUNT
+		{(1*10 + 7*10 + 2*10) / 30.0, 1, 7, 7, 12, 3},
+		{2, 2, 2, 2, 2, 1},
+		{unknown, unknown, unknown, unknown, unknown, unknown},
+		{3, 3, 3, 3, 3, 1},
+	}
+
+	db := New(30*time.Second, 10, WithConsolidation(cfs...))
+	for _, v := range data {
+		tm, _ := time.Parse(time.RFC3339, v.t)
+		if err := db.AddAt(v.v, tm); err != nil {
+			t.Fatalf("db.AddAt returned %v", err)
+		}
+	}
+
+	if db.Len() != len(expected) {
+		t.Fatalf("db.Len() = %v, want %v", db.Len(), len(expected))
+	}
+	for i, want := range expected {
+		for k, cf := range cfs {
+			if result := db.GetCF(i, cf); !sameValue(result, want[k]) {
+				t.Errorf("db.GetCF(%d, %v) returned %v, expected %v", i, cf, result, want[k])
+			}
+		}
+	}
+	if x := db.Get(0); x != db.GetCF(0, Average) {
+		t.Errorf("db.Get(0) = %v, expected the Average value", x)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var data = []struct {
+		t string
+		v float32
+	}{
+		{"2013-01-01T08:00:00Z", 4},
+		{"2013-01-01T08:00:40Z", 2}, // within heartbeat: fills 08:00:00 - 08:00:40
+		{"2013-01-01T08:01:50Z", 6}, // within heartbeat: fills back to 08:00:40
+		{"2013-01-01T08:04:10Z", 9}, // stale: 08:01:50 - 08:04:10 is unknown
+		{"2013-01-01T08:04:20Z", 3},
+	}
+
+	var expected = []float32{
+		2,
+		(2*10 + 6*20) / 30.0,
+		6,
+		6, // only 08:01:30 - 08:01:50 known
+		unknown,
+		unknown,
+		unknown,
+		unknown,
+		3, // 08:04:00 - 08:04:10 unknown, 08:04:10 - 08:04:20 is 3
+	}
+
+	db := New(30*time.Second, 10, WithHeartbeat(90*time.Second))
+	for _, v := range data {
+		tm, _ := time.Parse(time.RFC3339, v.t)
+		if err := db.AddAt(v.v, tm); err != nil {
+			t.Fatalf("db.AddAt returned %v", err)
+		}
+	}
+
+	if db.Len() != len(expected) {
+		t.Fatalf("db.Len() = %v, want %v", db.Len(), len(expected))
+	}
+	for i, want := range expected {
+		if result := db.Get(i); !sameValue(result, want) {
+			t.Errorf("db.Get(%d) returned %v, expected %v", i, result, want)
+		}
+	}
+}
+
+func TestXFF(t *testing.T) {
+	var data = []struct {
+		t string
+		v float32
+	}{
+		{"2013-01-01T08:00:00Z", 4},
+		{"2013-01-01T08:00:20Z", 2},
+		{"2013-01-01T08:01:00Z", 6}, // stale: 08:00:20 - 08:01:00 is unknown
+		{"2013-01-01T08:01:15Z", 8}, // 08:01:00 - 08:01:15 is 8
+		{"2013-01-01T08:01:40Z", 3}, // stale: 08:01:15 - 08:01:30 is unknown
+	}
+
+	var expected = []float32{
+		2,       // 10 of 30 seconds unknown
+		unknown, // entirely unknown
+		unknown, // 15 of 30 seconds unknown
+		unknown, // current timebox, 10 of 10 seconds unknown so far
+	}
+
+	db := New(30*time.Second, 10, WithHeartbeat(20*time.Second), WithXFF(0.4))
+	for _, v := range data {
+		tm, _ := time.Parse(time.RFC3339, v.t)
+		if err := db.AddAt(v.v, tm); err != nil {
+			t.Fatalf("db.AddAt returned %v", err)
+		}
+	}
+
+	if db.Len() != len(expected) {
+		t.Fatalf("db.Len() = %v, want %v", db.Len(), len(expected))
+	}
+	for i, want := range expected {
+		if result := db.Get(i); !sameValue(result, want) {
+			t.Errorf("db.Get(%d) returned %v, expected %v", i, result, want)
+		}
+	}
+}
+
+// TestConcurrentAccess is mostly of use when run with the race detector
+// (go test -race).
+func TestConcurrentAccess(t *testing.T) {
+	db := New(30*time.Second, 10, WithConsolidation(Average, Max))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			db.AddAt(float32(i), base.Add(time.Duration(i)*time.Second))
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if n := db.Len(); n > 0 {
+					db.Get(n - 1)
+					db.GetCF(0, Max)
+				}
+				db.Fetch(base, base.Add(time.Hour))
+				db.GobEncode()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if x := db.Get(db.Len() - 1); x != 995 {
+		t.Errorf("last timebox is %v, expected 995", x)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := New(30*time.Second, 10)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db.AddAt(1, base)
+
+	snap := db.Snapshot()
+	db.AddAt(2, base.Add(time.Minute))
+
+	if snap.Len() != 1 || snap.Get(0) != 1 {
+		t.Errorf("snapshot changed along with the original database")
+	}
+	if db.Len() != 3 {
+		t.Errorf("db.Len() = %v, want 3", db.Len())
+	}
+}
+
+// This test exercises daily timeboxes aligned to local midnight, across the
+// 25-hour day when daylight saving time ends
+func TestLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := New(24*time.Hour, 5, WithLocation(loc))
+	values := map[int]float32{2: 10, 3: 20, 4: 30}
+	start := time.Date(2013, 11, 2, 12, 0, 0, 0, loc)
+	for tm := start; tm.Before(start.Add(60 * time.Hour)); tm = tm.Add(time.Hour) {
+		db.AddAt(values[tm.Add(-time.Minute).In(loc).Day()], tm)
+	}
+
+	points := db.Fetch(start, start.Add(72*time.Hour))
+	expected := []struct {
+		day int
+		v   float32
+	}{{2, 10}, {3, 20}, {4, 30}}
+	if len(points) != len(expected) {
+		t.Fatalf("db.Fetch returned %v", points)
+	}
+	for i, e := range expected {
+		if want := time.Date(2013, 11, e.day, 0, 0, 0, 0, loc); !points[i].Time.Equal(want) || points[i].Value != e.v {
+			t.Errorf("point %d is %v at %v, expected %v at %v", i, points[i].Value,
+				points[i].Time.In(loc), e.v, want)
+		}
+	}
+	if x := db.Location(); x != loc {
+		t.Errorf("db.Location() = %v, want %v", x, loc)
+	}
+
+	// The location is kept by every form of persistence
+	b, _ := db.GobEncode()
+	decoded := new(Db)
+	if err := decoded.GobDecode(b); err != nil || !decoded.equals(db) {
+		t.Errorf("GobDecode returned %v, or a different db", err)
+	}
+	if _, err := db.GobEncodeVersion(7); err == nil {
+		t.Errorf("GobEncodeVersion(7) of db with a location succeeded")
+	}
+	b, _ = db.MarshalJSON()
+	decoded = new(Db)
+	if err := decoded.UnmarshalJSON(b); err != nil || decoded.Location().String() != loc.String() ||
+		!sameFetch(decoded.Fetch(start, start.Add(72*time.Hour)), db.Fetch(start, start.Add(72*time.Hour))) {
+		t.Errorf("UnmarshalJSON of %s returned %v, or a different db", b, err)
+	}
+	path := filepath.Join(t.TempDir(), "local.db")
+	file, _ := Create(path, 24*time.Hour, 5, WithLocation(loc), WithOffset(6*time.Hour))
+	file.Close()
+	if reopened, err := Open(path); err != nil || !reopened.equals(file) {
+		t.Errorf("Open returned %v, or a different db", err)
+	} else {
+		reopened.Close()
+	}
+}
+
+// This test exercises monthly timeboxes, which average months of different
+// lengths
+func TestCalendar(t *testing.T) {
+	db := NewCalendar(Month, 4)
+	if db.Calendar() != Month || db.Res() != 0 {
+		t.Errorf("db.Calendar() = %v and db.Res() = %v, want MONTH and 0", db.Calendar(), db.Res())
+	}
+
+	start := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	for tm := start; tm.Before(time.Date(2013, 4, 1, 1, 0, 0, 0, time.UTC)); tm = tm.Add(time.Hour) {
+		db.AddAt(float32(tm.Add(-time.Minute).Day()), tm)
+	}
+
+	// The average day of the month is the middle of the month
+	points := db.Fetch(start, start.AddDate(0, 3, 0))
+	expected := []struct {
+		month time.Month
+		v     float32
+	}{{time.January, 16}, {time.February, 14.5}, {time.March, 16}}
+	if len(points) != len(expected) {
+		t.Fatalf("db.Fetch returned %v", points)
+	}
+	for i, e := range expected {
+		if want := time.Date(2013, e.month, 1, 0, 0, 0, 0, time.UTC); !points[i].Time.Equal(want) ||
+			math.Abs(float64(points[i].Value-e.v)) > 1e-3 {
+			t.Errorf("point %d is %v at %v, expected %v at %v", i, points[i].Value,
+				points[i].Time, e.v, want)
+		}
+	}
+
+	// The unit is kept by gob and JSON
+	b, _ := db.GobEncode()
+	decoded := new(Db)
+	if err := decoded.GobDecode(b); err != nil || !decoded.equals(db) {
+		t.Errorf("GobDecode returned %v, or a different db", err)
+	}
+	if _, err := db.GobEncodeVersion(8); err == nil {
+		t.Errorf("GobEncodeVersion(8) of calendar db succeeded")
+	}
+	b, _ = db.MarshalJSON()
+	decoded = new(Db)
+	if err := decoded.UnmarshalJSON(b); err != nil || decoded.Calendar() != Month ||
+		!sameFetch(decoded.Fetch(start, start.AddDate(0, 3, 0)), points) {
+		t.Errorf("UnmarshalJSON of %s returned %v, or a different db", b, err)
+	}
+}
@@ -0,0 +1,416 @@
+/*
+ * File:	export.go
+ *
+ * Implements exporting and importing databases as JSON and CSV.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*****************************************************************************/
+// What follows is support for getting data out of a Db in a form people and
+// other systems can read, and for building a Db back up from it. Both JSON
+// and CSV describe the database as a list of timeboxes, each with a time and
+// a value for each consolidation function, which fill turns back into a
+// ring.
+/*****************************************************************************/
+
+type jsonDb struct {
+	Resolution     float64         `json:"resolution"`         // seconds
+	Calendar       *Calendar       `json:"calendar,omitempty"` // nil unless made by NewCalendar
+	Offset         float64         `json:"offset,omitempty"`   // seconds
+	Location       string          `json:"location,omitempty"` // empty for UTC
+	Capacity       int             `json:"capacity"`
+	Consolidations []Consolidation `json:"consolidations"`
+	DataSource     DataSource      `json:"dataSource"`
+	Heartbeat      float64         `json:"heartbeat"` // seconds
+	XFF            float64         `json:"xff"`
+	LastUpdate     *time.Time      `json:"lastUpdate,omitempty"`
+	LastReading    json.Number     `json:"lastReading,omitempty"`
+	Points         []jsonPoint     `json:"points"`
+}
+
+type jsonPoint struct {
+	Time   time.Time  `json:"time"`
+	Values []*float32 `json:"values"` // nil for unknown
+}
+
+// seconds converts a time in seconds, as written in JSON, to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Round(s * float64(time.Second)))
+}
+
+// MarshalJSON implements the json.Marshaler interface. The database is
+// described by its settings, the time of its last update, and a point for
+// each timebox it holds, giving the start time of the timebox and its values
+// in the order of "consolidations". Unknown values are null.
+func (db *Db) MarshalJSON() ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	d := jsonDb{
+		Resolution:     db.res.Seconds(),
+		Offset:         db.offset.Seconds(),
+		Capacity:       db.capacity(),
+		Consolidations: db.cfs,
+		DataSource:     db.kind,
+		Heartbeat:      db.heartbeat.Seconds(),
+		XFF:            db.xff,
+		Points:         []jsonPoint{},
+	}
+
+	if db.unit != 0 {
+		unit := db.unit
+		d.Calendar = &unit
+	}
+	if db.loc != nil {
+		d.Location = db.loc.String()
+	}
+	if db.tail != -1 {
+		last := db.lastEntry.UTC()
+		d.LastUpdate = &last
+		if db.kind == Counter {
+			d.LastReading = json.Number(strconv.FormatUint(db.lastCount, 10))
+		} else {
+			d.LastReading = json.Number(strconv.FormatFloat(db.lastRaw, 'g', -1, 64))
+		}
+	}
+
+	t := db.oldest()
+	for i := 0; i < db.length(); i, t = i+1, db.step(t, 1) {
+		p := jsonPoint{Time: t}
+		for _, v := range db.box(db.slot(i)) {
+			if IsUnknown(v) {
+				p.Values = append(p.Values, nil)
+			} else {
+				p.Values = append(p.Values, &v)
+			}
+		}
+		d.Points = append(d.Points, p)
+	}
+
+	return json.Marshal(d)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, replacing the
+// contents of the database with those described by data, as written by
+// MarshalJSON. It returns ErrKeptInFile for a database kept in a file (see
+// Open), which can't be replaced.
+func (db *Db) UnmarshalJSON(data []byte) error {
+	var d jsonDb
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+
+	res := seconds(d.Resolution)
+	if (res <= 0 && d.Calendar == nil) || d.Capacity <= 0 {
+		return errors.New("goaround: resolution and capacity must be positive")
+	}
+	if err := checkConsolidations(d.Consolidations); err != nil {
+		return err
+	}
+	if _, err := d.DataSource.MarshalText(); err != nil {
+		return err
+	}
+	if d.Heartbeat < 0 || !(d.XFF >= 0 && d.XFF <= 1) {
+		return errors.New("goaround: heartbeat or xff out of range")
+	}
+
+	loc := time.UTC
+	if d.Location != "" {
+		var err error
+		if loc, err = time.LoadLocation(d.Location); err != nil {
+			return err
+		}
+	}
+
+	opts := []Option{WithConsolidation(d.Consolidations...),
+		WithDataSource(d.DataSource), WithXFF(d.XFF),
+		WithHeartbeat(seconds(d.Heartbeat)), WithLocation(loc),
+		WithOffset(seconds(d.Offset))}
+	var n *Db
+	if d.Calendar != nil {
+		n = NewCalendar(*d.Calendar, d.Capacity, opts...)
+	} else {
+		n = New(res, d.Capacity, opts...)
+	}
+
+	boxes := make([]boxValues, len(d.Points))
+	for i, p := range d.Points {
+		if len(p.Values) != len(d.Consolidations) {
+			return fmt.Errorf("goaround: point %d has %d values, expected %d",
+				i, len(p.Values), len(d.Consolidations))
+		}
+		boxes[i].t = p.Time
+		for _, v := range p.Values {
+			if v == nil {
+				boxes[i].v = append(boxes[i].v, unknown)
+			} else {
+				boxes[i].v = append(boxes[i].v, *v)
+			}
+		}
+	}
+
+	var last time.Time
+	if d.LastUpdate != nil {
+		last = *d.LastUpdate
+	}
+	if err := n.fill(boxes, last); err != nil {
+		return err
+	}
+
+	if d.LastReading != "" {
+		raw, err := d.LastReading.Float64()
+		if err != nil {
+			return err
+		}
+		n.lastRaw, n.lastCount = raw, uint64(math.Max(0, raw))
+		if count, err := strconv.ParseUint(string(d.LastReading), 10, 64); err == nil {
+			n.lastCount = count
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file != nil {
+		return ErrKeptInFile
+	}
+
+	db.boxing = n.boxing
+	db.cfs = n.cfs
+	db.kind = n.kind
+	db.entries = n.entries
+	db.head = n.head
+	db.tail = n.tail
+	db.currentStart = n.currentStart
+	db.currentStop = n.currentStop
+	db.lastEntry = n.lastEntry
+	db.lastRaw = n.lastRaw
+	db.lastCount = n.lastCount
+	db.heartbeat = n.heartbeat
+	db.xff = n.xff
+	db.unknownTime = n.unknownTime
+	db.updates++
+
+	return nil
+}
+
+// WriteCSV writes the timeboxes the database holds to w as CSV. The first row
+// is a header naming the columns: "time", followed by the database's
+// consolidation functions. Each following row gives the start time of a
+// timebox, in RFC 3339 format, and its values, with unknown values left empty.
+func (db *Db) WriteCSV(w io.Writer) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	cw := csv.NewWriter(w)
+	row := []string{"time"}
+	for _, cf := range db.cfs {
+		row = append(row, cf.String())
+	}
+	cw.Write(row)
+
+	t := db.oldest()
+	for i := 0; i < db.length(); i, t = i+1, db.step(t, 1) {
+		row = row[:0]
+		row = append(row, t.Format(time.RFC3339Nano))
+		for _, v := range db.box(db.slot(i)) {
+			if IsUnknown(v) {
+				row = append(row, "")
+			} else {
+				row = append(row, strconv.FormatFloat(float64(v), 'g', -1, 32))
+			}
+		}
+		cw.Write(row)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadCSV creates a database with the given resolution, capacity and options,
+// as for New, and fills it with the timeboxes read from r as CSV. The first
+// row is a header. If the names of its value columns (every column after the
+// first) are all names of consolidation functions, as written by WriteCSV,
+// the database keeps those functions and each column is read into its
+// function. Otherwise the value columns are read, in order, into the
+// database's consolidation functions.
+//
+// Each following row holds a time, in RFC 3339 format or as whole seconds
+// since the Unix epoch, and the values of the timebox at that time. Values
+// that are empty, "NaN" or "U" (as rrdtool writes them) are unknown. Rows must
+// be in chronological order, and timeboxes without a row are unknown. The
+// database's last update is taken to be the end of the last timebox.
+func ReadCSV(r io.Reader, resolution time.Duration, capacity int, opts ...Option) (*Db, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	cfs := make([]Consolidation, len(header)-1)
+	named := true
+	for i, name := range header[1:] {
+		if cfs[i].UnmarshalText([]byte(name)) != nil {
+			named = false
+			break
+		}
+	}
+	if named && checkConsolidations(cfs) == nil {
+		opts = append([]Option{WithConsolidation(cfs...)}, opts...)
+	} else {
+		cfs = nil
+	}
+
+	db := New(resolution, capacity, opts...)
+
+	// column[k] is the column holding the k'th consolidation function
+	if cfs == nil && len(header) != len(db.cfs)+1 {
+		return nil, fmt.Errorf("goaround: CSV has %d value columns, expected %d",
+			len(header)-1, len(db.cfs))
+	}
+	column := make([]int, len(db.cfs))
+	for k, cf := range db.cfs {
+		if cfs == nil {
+			column[k] = k + 1
+			continue
+		}
+		for i, other := range cfs {
+			if other == cf {
+				column[k] = i + 1
+			}
+		}
+		if column[k] == 0 {
+			return nil, fmt.Errorf("goaround: CSV has no %v column", cf)
+		}
+	}
+
+	var boxes []boxValues
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b := boxValues{v: make([]float32, len(db.cfs))}
+		if b.t, err = parseCSVTime(row[0]); err != nil {
+			return nil, fmt.Errorf("goaround: CSV line %d: %v", line, err)
+		}
+		for k, i := range column {
+			if b.v[k], err = parseCSVValue(row[i]); err != nil {
+				return nil, fmt.Errorf("goaround: CSV line %d: %v", line, err)
+			}
+		}
+		boxes = append(boxes, b)
+	}
+
+	if err := db.fill(boxes, time.Time{}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// parseCSVTime parses a time in RFC 3339 format or in seconds since the
+// epoch.
+func parseCSVTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseCSVValue parses a value, allowing for the ways of writing unknown.
+func parseCSVValue(s string) (float32, error) {
+	switch s {
+	case "", "NaN", "U":
+		return unknown, nil
+	}
+	v, err := strconv.ParseFloat(s, 32)
+	return float32(v), err
+}
+
+// boxValues is a timebox being imported into a database: a time within the
+// timebox, and its values, one for each of the database's consolidation
+// functions.
+type boxValues struct {
+	t time.Time
+	v []float32
+}
+
+// fill fills the empty database db with boxes, which must be in chronological
+// order and each in a later timebox than the one before. Timeboxes between
+// them are unknown, and only the latest ones the database has room for are
+// kept. The last update is set to last if that falls within the final
+// timebox, or else to the end of the final timebox.
+func (db *Db) fill(boxes []boxValues, last time.Time) error {
+	capacity := db.capacity()
+
+	for _, b := range boxes {
+		t0, t1 := db.boxTime(b.t)
+		if db.tail != -1 && t0.Before(db.currentStop) {
+			return fmt.Errorf("%w: timebox at %v is not after the one before",
+				ErrOutOfOrder, b.t)
+		}
+
+		// Move on to t0's timebox, unless it's so far on that nothing held
+		// so far would be kept, in which case start afresh
+		moved := 0
+		for ; db.tail != -1 && db.currentStart.Before(t0) && moved < capacity; moved++ {
+			db.lastEntry = db.currentStop
+			db.moveForward()
+		}
+		if db.tail == -1 || db.currentStart.Before(t0) {
+			for i := range db.entries {
+				db.entries[i] = unknown
+			}
+			db.head, db.tail = 0, 0
+			db.currentStart, db.currentStop = t0, t1
+		}
+		copy(db.box(db.tail), b.v)
+	}
+
+	db.unknownTime = 0
+	db.lastEntry = db.currentStop
+	if !last.Before(db.currentStart) && last.Before(db.currentStop) {
+		db.lastEntry = last.UTC()
+	}
+	return nil
+}
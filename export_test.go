@@ -0,0 +1,204 @@
+/*
+ * File:	export_test.go
+ *
+ * Implements tests for the export.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameFetch tells you if a and b hold the same points.
+func sameFetch(a, b []Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].Missing != b[i].Missing ||
+			!sameValue(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJSON(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5, WithConsolidation(Average, Max), WithDataSource(Counter),
+		WithHeartbeat(time.Minute), WithXFF(0.5))
+	for i, s := range []int{0, 20, 40, 60, 80, 180, 200, 215} {
+		db.AddCounterAt(uint64(1<<60+i*300), base.Add(time.Duration(s)*time.Second))
+	}
+
+	b, err := json.Marshal(db)
+	if err != nil {
+		t.Fatalf("json.Marshal returned %v", err)
+	}
+	for _, want := range []string{`"resolution":30`, `"capacity":5`,
+		`"consolidations":["AVERAGE","MAX"]`, `"dataSource":"COUNTER"`,
+		`"heartbeat":60`, `"xff":0.5`, `"lastUpdate":"2013-01-01T08:03:35Z"`,
+		`"lastReading":1152921504606849076`,
+		`{"time":"2013-01-01T08:01:30Z","values":[null,null]}`} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("JSON %s does not contain %s", b, want)
+		}
+	}
+
+	loaded := new(Db)
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatalf("json.Unmarshal returned %v", err)
+	}
+	end := base.Add(time.Hour)
+	for _, cf := range db.Consolidations() {
+		if !sameFetch(loaded.FetchCF(cf, base, end), db.FetchCF(cf, base, end)) {
+			t.Errorf("%v of decoded db does not match", cf)
+		}
+	}
+	if b2, _ := json.Marshal(loaded); !bytes.Equal(b, b2) {
+		t.Errorf("JSON of decoded db is %s, expected %s", b2, b)
+	}
+
+	// The decoded db carries on from where the original left off
+	next := base.Add(240 * time.Second)
+	db.AddCounterAt(1<<60+3000, next)
+	loaded.AddCounterAt(1<<60+3000, next)
+	if !sameFetch(loaded.Fetch(base, end), db.Fetch(base, end)) {
+		t.Errorf("Decoded db does not match after adding another sample")
+	}
+
+	// An empty db has no points
+	b, _ = json.Marshal(New(30*time.Second, 5))
+	if !bytes.Contains(b, []byte(`"points":[]`)) || bytes.Contains(b, []byte(`lastUpdate`)) {
+		t.Errorf("JSON of empty db is %s", b)
+	}
+
+	// Sub-second resolutions are fractions of a second
+	fine := New(250*time.Millisecond, 5)
+	fine.AddAt(1, base)
+	fine.AddAt(2, base.Add(300*time.Millisecond))
+	b, _ = json.Marshal(fine)
+	loaded = new(Db)
+	if err := json.Unmarshal(b, loaded); err != nil || loaded.Res() != 250*time.Millisecond ||
+		!sameFetch(loaded.Fetch(base, end), fine.Fetch(base, end)) {
+		t.Errorf("json.Unmarshal of %s returned %v, or a different db", b, err)
+	}
+
+	for _, bad := range []string{
+		`{"resolution":0,"capacity":5,"consolidations":["AVERAGE"]}`,
+		`{"resolution":30,"capacity":5,"consolidations":[]}`,
+		`{"resolution":30,"capacity":5,"consolidations":["MEDIAN"]}`,
+		`{"resolution":30,"capacity":5,"consolidations":["AVERAGE"],"xff":2}`,
+		`{"resolution":30,"capacity":5,"consolidations":["AVERAGE"],
+			"points":[{"time":"2013-01-01T08:00:00Z","values":[1,2]}]}`,
+		`{"resolution":30,"capacity":5,"consolidations":["AVERAGE"],
+			"points":[{"time":"2013-01-01T08:00:00Z","values":[1]},
+				{"time":"2013-01-01T08:00:10Z","values":[2]}]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), new(Db)); err == nil {
+			t.Errorf("json.Unmarshal accepted %s", bad)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5, WithConsolidation(Average, Max))
+	for _, s := range []int{0, 20, 40, 60, 80, 180, 200} {
+		db.AddAt(float32(s)/10, base.Add(time.Duration(s)*time.Second))
+	}
+
+	var buf bytes.Buffer
+	if err := db.WriteCSV(&buf); err != nil {
+		t.Fatalf("db.WriteCSV returned %v", err)
+	}
+	want := "time,AVERAGE,MAX\n" +
+		"2013-01-01T08:01:00Z,8,8\n" +
+		"2013-01-01T08:01:30Z,,\n" +
+		"2013-01-01T08:02:00Z,,\n" +
+		"2013-01-01T08:02:30Z,,\n" +
+		"2013-01-01T08:03:00Z,20,20\n"
+	if buf.String() != want {
+		t.Errorf("db.WriteCSV wrote\n%s\nexpected\n%s", buf.String(), want)
+	}
+
+	loaded, err := ReadCSV(strings.NewReader(want), 30*time.Second, 5)
+	if err != nil {
+		t.Fatalf("ReadCSV returned %v", err)
+	}
+	end := base.Add(time.Hour)
+	for _, cf := range db.Consolidations() {
+		if !sameFetch(loaded.FetchCF(cf, base, end), db.FetchCF(cf, base, end)) {
+			t.Errorf("%v of db read from CSV does not match", cf)
+		}
+	}
+
+	// Another system's dump, with its own column name, times since the
+	// epoch, rrdtool's unknowns and gaps. Only the last 5 timeboxes fit.
+	dump := "timestamp,value\n" +
+		"1357027200,1\n" +
+		"1357027230,2\n" +
+		"1357027260,3\n" +
+		"1357027290,U\n" +
+		"1357027320,5\n" +
+		"1357027410,8\n"
+	loaded, err = ReadCSV(strings.NewReader(dump), 30*time.Second, 5, WithConsolidation(Last))
+	if err != nil {
+		t.Fatalf("ReadCSV returned %v", err)
+	}
+	expected := []float32{3, unknown, 5, unknown, unknown, 8}
+	points := loaded.Fetch(base, end)
+	if len(points) != len(expected)-1 || loaded.Len() != 5 {
+		t.Fatalf("db read from dump has %d points and length %d, expected 5",
+			len(points), loaded.Len())
+	}
+	for i, p := range points {
+		if !sameValue(p.Value, expected[i+1]) {
+			t.Errorf("point %d of dump is %v, expected %v", i, p.Value, expected[i+1])
+		}
+	}
+
+	for _, bad := range []string{
+		"time,AVERAGE,MAX\n2013-01-01T08:01:00Z,x,8\n",
+		"time,AVERAGE,MAX\nyesterday,7,8\n",
+		"time,AVERAGE,MAX\n2013-01-01T08:01:00Z,7,8\n2013-01-01T08:01:00Z,7,8\n",
+		"time,a,b,c\n2013-01-01T08:01:00Z,7,8,9\n",
+	} {
+		if _, err := ReadCSV(strings.NewReader(bad), 30*time.Second, 5); err == nil {
+			t.Errorf("ReadCSV accepted %q", bad)
+		}
+	}
+	if _, err := ReadCSV(strings.NewReader(want), 30*time.Second, 5, WithConsolidation(Min)); err == nil {
+		t.Errorf("ReadCSV accepted CSV without a MIN column for a MIN db")
+	}
+}
@@ -0,0 +1,433 @@
+/*
+ * File:	file.go
+ *
+ * Implements keeping a database in a fixed-layout file that is updated in
+ * place as samples are added.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+/*****************************************************************************/
+// A database file is a fixed-size header followed by the entries of the ring,
+// each a little-endian float32, in the same order as Db.entries. Neither part
+// ever changes size, so adding a sample only needs to rewrite the header and
+// the entries of the timeboxes it touched.
+//
+// Version 1 of the header gave the resolution in seconds; version 2 gives it
+// in nanoseconds. Version 3 adds the settings that follow the entries. Files
+// of older versions are still read, and are upgraded to the current version
+// when they are opened.
+/*****************************************************************************/
+
+const fileVersion uint32 = 3
+
+var fileMagic = [8]byte{'g', 'o', 'a', 'r', 'o', 'u', 'n', 'd'}
+
+// ErrBadFile is returned by Open and LoadFile when the file is not a database
+// file, or is damaged, and by GobDecode when the data is.
+var ErrBadFile = errors.New("goaround: not a valid database file")
+
+// ErrKeptInFile is returned by GobDecode, LoadFile and UnmarshalJSON for a
+// database kept in a file (see Open), whose file could not hold the database
+// they describe. Close the database first to replace it in memory only.
+var ErrKeptInFile = errors.New("goaround: can't replace a database kept in a file")
+
+// fileTime is a time.Time as stored in the header.
+type fileTime struct {
+	Sec  int64
+	Nsec int64
+}
+
+func toFileTime(t time.Time) fileTime {
+	return fileTime{t.Unix(), int64(t.Nanosecond())}
+}
+
+func (ft fileTime) time() time.Time {
+	return time.Unix(ft.Sec, ft.Nsec).UTC()
+}
+
+type fileHeader struct {
+	Magic        [8]byte
+	Version      uint32
+	NumCfs       uint32
+	Cfs          [8]uint8
+	Kind         int64
+	Res          int64
+	Capacity     int64
+	Head         int64
+	Tail         int64
+	CurrentStart fileTime
+	CurrentStop  fileTime
+	LastEntry    fileTime
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  int64
+	Heartbeat    int64
+	Xff          float64
+}
+
+// fileHeaderSize is the size of the header on disk. It is a multiple of 8,
+// so the entries that follow are well aligned.
+var fileHeaderSize = binary.Size(fileHeader{})
+
+// maxLocationName is the longest location name a database file can hold.
+const maxLocationName = 56
+
+// fileSettings follows the entries. It holds the settings of the database
+// that were added after the header was laid out, and that never change.
+type fileSettings struct {
+	Offset   int64
+	Location [maxLocationName]byte // name of the location, empty for UTC
+}
+
+var fileSettingsSize = binary.Size(fileSettings{})
+
+// dbFile is the file a Db is kept in.
+type dbFile struct {
+	f    *os.File
+	data []byte // the whole file, if it is memory-mapped (see OpenMapped)
+}
+
+// Create creates a new database file at path, failing if the file already
+// exists, and returns the new (empty) database kept in it. The arguments are
+// the same as for New, except that the name of any location configured by
+// WithLocation must be no more than 56 bytes long. The database must be closed
+// with Close when it is no longer needed.
+func Create(path string, resolution time.Duration, capacity int, opts ...Option) (*Db, error) {
+	db := New(resolution, capacity, opts...)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	db.file = &dbFile{f: f}
+
+	if err := db.file.writeSettings(db); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := db.file.update(db, -1, 0); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return db, nil
+}
+
+// Open opens the database file at path, created by Create, and returns the
+// database kept in it. Every sample added to the database is written through
+// to the file, touching only the parts of the file that changed. The database
+// must be closed with Close when it is no longer needed.
+func Open(path string) (*Db, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := readFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	db.file = &dbFile{f: f}
+	return db, nil
+}
+
+// readFile reads the database stored in f, upgrading f if it is of an older
+// version.
+func readFile(f *os.File) (*Db, error) {
+	db, err := readHeader(f, func(n int) ([]float32, error) {
+		return make([]float32, n), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4*len(db.entries))
+	if _, err := f.ReadAt(buf, int64(fileHeaderSize)); err != nil {
+		return nil, ErrBadFile
+	}
+	for i := range db.entries {
+		db.entries[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return db, nil
+}
+
+// readHeader reads the header and settings of the database file f, returning
+// a database as described by them, whose entries are those returned by
+// entries for the number the file holds; readHeader doesn't fill them in. A
+// file of an older version, which has no settings, is upgraded to the current
+// version before entries is called.
+func readHeader(f *os.File, entries func(n int) ([]float32, error)) (*Db, error) {
+	var h fileHeader
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(fileHeaderSize)),
+		binary.LittleEndian, &h); err != nil {
+		return nil, ErrBadFile
+	}
+	db, err := h.db()
+	if err != nil {
+		return nil, err
+	}
+	n := int(h.Capacity) * len(db.cfs)
+
+	if h.Version < fileVersion {
+		if info, err := f.Stat(); err != nil {
+			return nil, err
+		} else if info.Size() < settingsAt(n) {
+			return nil, ErrBadFile
+		}
+
+		// Upgrading takes the whole database, but only happens once
+		db.entries = make([]float32, n)
+		if err := (&dbFile{f: f}).upgrade(db); err != nil {
+			return nil, err
+		}
+	} else {
+		var s fileSettings
+		if err := binary.Read(io.NewSectionReader(f, settingsAt(n), int64(fileSettingsSize)),
+			binary.LittleEndian, &s); err != nil {
+			return nil, ErrBadFile
+		}
+		db.offset = time.Duration(s.Offset)
+		if db.offset < 0 || db.offset >= db.res {
+			return nil, ErrBadFile
+		}
+		if name := string(bytes.TrimRight(s.Location[:], "\x00")); name != "" {
+			if db.loc, err = time.LoadLocation(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if db.entries, err = entries(n); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the file the database is kept in, after which the database
+// remains usable, but only in memory. For a memory-mapped database, this
+// means reading all of its entries into memory first. Close does nothing for
+// a database that isn't kept in a file.
+func (db *Db) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file == nil {
+		return nil
+	}
+
+	var err error
+	if db.file.data != nil {
+		// Move the entries out of the mapping before it goes away
+		db.entries = append([]float32(nil), db.entries...)
+		err = munmap(db.file.data)
+	}
+	if cerr := db.file.f.Close(); err == nil {
+		err = cerr
+	}
+	db.file = nil
+	return err
+}
+
+// Sync commits the file the database is kept in to stable storage. Sync does
+// nothing for a database that isn't kept in a file.
+func (db *Db) Sync() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.file == nil {
+		return nil
+	}
+	return db.file.f.Sync()
+}
+
+// header returns the file header describing db.
+func (db *Db) header() fileHeader {
+	h := fileHeader{
+		Magic:        fileMagic,
+		Version:      fileVersion,
+		NumCfs:       uint32(len(db.cfs)),
+		Kind:         int64(db.kind),
+		Res:          int64(db.res),
+		Capacity:     int64(db.capacity()),
+		Head:         int64(db.head),
+		Tail:         int64(db.tail),
+		CurrentStart: toFileTime(db.currentStart),
+		CurrentStop:  toFileTime(db.currentStop),
+		LastEntry:    toFileTime(db.lastEntry),
+		LastRaw:      db.lastRaw,
+		LastCount:    db.lastCount,
+		UnknownTime:  int64(db.unknownTime),
+		Heartbeat:    int64(db.heartbeat),
+		Xff:          db.xff,
+	}
+	for k, cf := range db.cfs {
+		h.Cfs[k] = uint8(cf)
+	}
+	return h
+}
+
+// db returns a new database as described by the header, without its entries.
+func (h *fileHeader) db() (*Db, error) {
+	if h.Magic != fileMagic || h.Version < 1 || h.Version > fileVersion {
+		return nil, ErrBadFile
+	}
+	if h.Version == 1 {
+		if h.Res > math.MaxInt64/int64(time.Second) {
+			return nil, ErrBadFile
+		}
+		h.Res *= int64(time.Second)
+	}
+	if h.NumCfs == 0 || h.NumCfs > uint32(len(consolidationNames)) ||
+		h.Res <= 0 || h.Capacity <= 0 || h.Capacity > math.MaxInt32 ||
+		h.Head < -1 || h.Head >= h.Capacity || h.Tail < -1 || h.Tail >= h.Capacity ||
+		(h.Head == -1) != (h.Tail == -1) ||
+		(h.Tail != -1 && !h.CurrentStop.time().After(h.CurrentStart.time())) ||
+		h.Kind < 0 || h.Kind >= int64(len(dataSourceNames)) ||
+		h.Heartbeat < 0 || !(h.Xff >= 0 && h.Xff <= 1) {
+		return nil, ErrBadFile
+	}
+
+	db := new(Db)
+	db.res = time.Duration(h.Res)
+	for k := 0; k < int(h.NumCfs); k++ {
+		if int(h.Cfs[k]) >= len(consolidationNames) {
+			return nil, ErrBadFile
+		}
+		db.cfs = append(db.cfs, Consolidation(h.Cfs[k]))
+	}
+	db.kind = DataSource(h.Kind)
+	db.head = int(h.Head)
+	db.tail = int(h.Tail)
+	if db.tail != -1 {
+		db.currentStart = h.CurrentStart.time()
+		db.currentStop = h.CurrentStop.time()
+		db.lastEntry = h.LastEntry.time()
+	}
+	db.lastRaw = h.LastRaw
+	db.lastCount = h.LastCount
+	db.unknownTime = time.Duration(h.UnknownTime)
+	db.heartbeat = time.Duration(h.Heartbeat)
+	db.xff = h.Xff
+	return db, nil
+}
+
+// update writes the changes made to db by a sample to the file: the header,
+// and the entries of the timeboxes from oldTail onwards, where the tail has
+// since moved forward moves times. An oldTail of -1 writes every entry. If
+// the file is memory-mapped, the entries are already in place and only the
+// header needs writing.
+func (file *dbFile) update(db *Db, oldTail int, moves int) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, db.header())
+	if file.data != nil {
+		copy(file.data, buf.Bytes())
+		return nil
+	}
+
+	capacity := db.capacity()
+	if oldTail == -1 || moves >= capacity {
+		if err := file.writeBoxes(db, 0, capacity); err != nil {
+			return err
+		}
+	} else if end := oldTail + moves + 1; end <= capacity {
+		if err := file.writeBoxes(db, oldTail, end); err != nil {
+			return err
+		}
+	} else {
+		if err := file.writeBoxes(db, oldTail, capacity); err != nil {
+			return err
+		}
+		if err := file.writeBoxes(db, 0, end-capacity); err != nil {
+			return err
+		}
+	}
+
+	_, err := file.f.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// settingsAt returns where the settings are in a file holding n entries.
+func settingsAt(n int) int64 {
+	return int64(fileHeaderSize + 4*n)
+}
+
+// writeSettings writes the settings of db to the file.
+func (file *dbFile) writeSettings(db *Db) error {
+	if db.unit != 0 {
+		return errors.New("goaround: database files can't hold calendar timeboxes")
+	}
+	s := fileSettings{Offset: int64(db.offset)}
+	if db.loc != nil {
+		if len(db.loc.String()) > maxLocationName {
+			return errors.New("goaround: location name too long for a database file")
+		}
+		copy(s.Location[:], db.loc.String())
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, s)
+	_, err := file.f.WriteAt(buf.Bytes(), settingsAt(len(db.entries)))
+	return err
+}
+
+// upgrade upgrades a file of an older version, holding db, to the current
+// version.
+func (file *dbFile) upgrade(db *Db) error {
+	if err := file.writeSettings(db); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, db.header())
+	_, err := file.f.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// writeBoxes writes the entries of the timeboxes in slots from to to-1.
+func (file *dbFile) writeBoxes(db *Db, from, to int) error {
+	n := len(db.cfs)
+	entries := db.entries[from*n : to*n]
+	buf := make([]byte, 4*len(entries))
+	for i, e := range entries {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(e))
+	}
+	_, err := file.f.WriteAt(buf, int64(fileHeaderSize+4*from*n))
+	return err
+}
@@ -0,0 +1,241 @@
+/*
+ * File:	file_test.go
+ *
+ * Implements tests for the file.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRoundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Create(path, 30*time.Second, 5, WithConsolidation(Average, Max), WithHeartbeat(time.Minute))
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	if _, err := Create(path, 30*time.Second, 5); err == nil {
+		t.Errorf("Create overwrote an existing file")
+	}
+
+	info, _ := os.Stat(path)
+	size := info.Size()
+	if want := int64(fileHeaderSize + 4*5*2 + fileSettingsSize); size != want {
+		t.Errorf("file is %d bytes, expected %d", size, want)
+	}
+
+	// Enough samples to wrap around the ring, written through as we go
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i < 20; i++ {
+		if err := db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second)); err != nil {
+			t.Fatalf("db.AddAt returned %v", err)
+		}
+
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open returned %v", err)
+		}
+		if !reopened.equals(db) {
+			t.Fatalf("file doesn't match database after sample %d", i)
+		}
+		reopened.Close()
+	}
+
+	// A long gap touches every timebox
+	db.AddAt(1, base.Add(time.Hour))
+	if err := db.Close(); err != nil {
+		t.Errorf("db.Close returned %v", err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open returned %v", err)
+	}
+	defer reopened.Close()
+	if !reopened.equals(db) {
+		t.Errorf("file doesn't match database after a long gap")
+	}
+
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Errorf("file changed size from %d to %d bytes", size, info.Size())
+	}
+}
+
+func TestOpenBadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "garbage.db")
+	os.WriteFile(path, []byte("this is not a database"), 0666)
+	if _, err := Open(path); !errors.Is(err, ErrBadFile) {
+		t.Errorf("Open returned %v, expected ErrBadFile", err)
+	}
+
+	// A file cut short
+	path = filepath.Join(dir, "short.db")
+	db, _ := Create(path, 30*time.Second, 5)
+	db.Close()
+	os.Truncate(path, int64(fileHeaderSize+4))
+	if _, err := Open(path); !errors.Is(err, ErrBadFile) {
+		t.Errorf("Open returned %v, expected ErrBadFile", err)
+	}
+
+	// Headers describing a database that couldn't exist
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	var tests = []func(h *fileHeader){
+		func(h *fileHeader) { h.Heartbeat = -1 },
+		func(h *fileHeader) { h.Xff = 1.5 },
+		func(h *fileHeader) { h.Xff = math.NaN() },
+		func(h *fileHeader) { h.CurrentStop = h.CurrentStart },
+		func(h *fileHeader) { h.Head = -1 },
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("bad%d.db", i))
+		db, _ := Create(path, 30*time.Second, 5)
+		db.AddAt(1, base)
+		db.Close()
+
+		h := db.header()
+		tt(&h)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, h)
+		f, _ := os.OpenFile(path, os.O_WRONLY, 0)
+		f.WriteAt(buf.Bytes(), 0)
+		f.Close()
+		if _, err := Open(path); !errors.Is(err, ErrBadFile) {
+			t.Errorf("Test %d: Open returned %v, expected ErrBadFile", i, err)
+		}
+	}
+}
+
+// A database kept in a file can't be replaced by decoding into it, as the
+// file could no longer hold it
+func TestDecodeIntoFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Create(path, 30*time.Second, 5)
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	defer db.Close()
+
+	other := New(time.Minute, 20, WithConsolidation(Average, Max))
+	b, _ := other.GobEncode()
+	j, _ := other.MarshalJSON()
+	other.SaveFile(filepath.Join(dir, "other.gar"))
+	for i, err := range []error{db.GobDecode(b), db.UnmarshalJSON(j),
+		db.LoadFile(filepath.Join(dir, "other.gar"))} {
+		if !errors.Is(err, ErrKeptInFile) {
+			t.Errorf("Test %d: decoding into an opened db returned %v, expected ErrKeptInFile", i, err)
+		}
+	}
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	if err := db.AddAt(1, base); err != nil {
+		t.Fatalf("db.AddAt returned %v", err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open returned %v", err)
+	}
+	defer reopened.Close()
+	if !reopened.equals(db) {
+		t.Errorf("file doesn't match the database")
+	}
+}
+
+func TestCreateLongLocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "long.db")
+	loc := time.FixedZone(strings.Repeat("x", maxLocationName+1), 0)
+	New(30*time.Second, 5, WithLocation(loc))
+	if _, err := Create(path, 30*time.Second, 5, WithLocation(loc)); err == nil {
+		t.Errorf("Create accepted a location name too long for the file")
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Create left a file behind after failing")
+	}
+}
+
+func TestCalendarFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "calendar.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	file := &dbFile{f: f}
+	if err := file.writeSettings(NewCalendar(Month, 5)); err == nil {
+		t.Errorf("writeSettings accepted a calendar db")
+	}
+}
+
+func TestOpenVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.db")
+	db, _ := Create(path, 30*time.Second, 5)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i < 10; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+	db.Close()
+
+	// Version 1 gave the resolution in seconds, and had no settings after
+	// the entries
+	h := db.header()
+	h.Version, h.Res = 1, 30
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	f, _ := os.OpenFile(path, os.O_WRONLY, 0)
+	f.WriteAt(buf.Bytes(), 0)
+	f.Truncate(int64(fileHeaderSize + 4*5))
+	f.Close()
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open of version 1 file returned %v", err)
+	}
+	if !reopened.equals(db) {
+		t.Errorf("version 1 file doesn't match database")
+	}
+	reopened.AddAt(42, base.Add(220*time.Second))
+	reopened.Close()
+
+	f, _ = os.Open(path)
+	defer f.Close()
+	binary.Read(f, binary.LittleEndian, &h)
+	if h.Version != fileVersion || h.Res != int64(30*time.Second) {
+		t.Errorf("file has version %d and resolution %d after update", h.Version, h.Res)
+	}
+}
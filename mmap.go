@@ -0,0 +1,100 @@
+/*
+ * File:	mmap.go
+ *
+ * Implements opening a database file with its entries memory-mapped.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// ErrMmapUnsupported is returned by OpenMapped on systems where database files
+// can't be memory-mapped.
+var ErrMmapUnsupported = errors.New("goaround: memory-mapped files not supported on this system")
+
+// OpenMapped is like Open, but rather than reading the entries of the database
+// into memory, it maps the file into memory and uses it in place. Reading the
+// database reads straight from the mapping, and samples added to it update
+// the mapping, leaving the operating system to write the changes back to the
+// file; call Sync to force that. Very many databases can be opened this way
+// without their entries taking up space on the heap until they are used.
+//
+// Entries are stored little-endian, so OpenMapped returns ErrMmapUnsupported
+// on big-endian systems, as well as on systems without mmap.
+func OpenMapped(path string) (*Db, error) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		return nil, ErrMmapUnsupported
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := mapFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// mapFile maps the database file f into memory and returns the database kept
+// in it. The entries are used in place, so are never read onto the heap.
+func mapFile(f *os.File) (*Db, error) {
+	var data []byte
+	db, err := readHeader(f, func(n int) ([]float32, error) {
+		size := settingsAt(n) + int64(fileSettingsSize)
+		if info, err := f.Stat(); err != nil {
+			return nil, err
+		} else if info.Size() != size {
+			return nil, ErrBadFile
+		}
+
+		var err error
+		if data, err = mmap(f, int(size)); err != nil {
+			return nil, err
+		}
+
+		// The header size is a multiple of 8, and the mapping is page
+		// aligned, so the entries are suitably aligned to be used as
+		// float32s directly.
+		return unsafe.Slice((*float32)(unsafe.Pointer(&data[fileHeaderSize])), n), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.file = &dbFile{f: f, data: data}
+	return db, nil
+}
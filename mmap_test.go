@@ -0,0 +1,108 @@
+//go:build unix
+
+/*
+ * File:	mmap_test.go
+ *
+ * Implements tests for the mmap.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMappedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Create(path, 30*time.Second, 5, WithConsolidation(Average, Min))
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	db.Close()
+
+	mapped, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped returned %v", err)
+	}
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i < 20; i++ {
+		if err := mapped.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second)); err != nil {
+			t.Fatalf("mapped.AddAt returned %v", err)
+		}
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+
+		// Another reader of the file sees the changes straight away
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open returned %v", err)
+		}
+		if !reopened.equals(mapped) || !reopened.equals(db) {
+			t.Fatalf("file doesn't match database after sample %d", i)
+		}
+		reopened.Close()
+	}
+
+	if err := mapped.Sync(); err != nil {
+		t.Errorf("mapped.Sync returned %v", err)
+	}
+	if err := mapped.Close(); err != nil {
+		t.Errorf("mapped.Close returned %v", err)
+	}
+
+	// Still usable, from memory, after the mapping is gone
+	if !mapped.equals(db) || mapped.Fetch(base, base.Add(time.Hour)) == nil {
+		t.Errorf("database changed when closed")
+	}
+}
+
+// Opening a mapped database doesn't read its entries onto the heap
+func TestMappedAllocs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.db")
+	const capacity = 1 << 20
+	db, err := Create(path, time.Second, capacity)
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	db.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	mapped, err := OpenMapped(path)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("OpenMapped returned %v", err)
+	}
+	defer mapped.Close()
+	if n := after.TotalAlloc - before.TotalAlloc; n >= 4*capacity {
+		t.Errorf("OpenMapped allocated %d bytes for %d entries", n, capacity)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * File:	multi.go
+ *
+ * Implements a database made up of several round-robin archives of differing
+ * resolution, all fed from a single stream of samples.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import "math"
+import "sort"
+import "sync"
+import "time"
+
+// Archive describes one of the round-robin archives kept by a Multi.
+type Archive struct {
+	Res      time.Duration // resolution - how much time each timebox covers
+	Capacity int           // number of timeboxes kept
+}
+
+// Multi is a database that keeps several archives, each with its own
+// resolution and capacity, in the manner of rrdtool's RRAs, so it can, for
+// example, keep one-minute data for a day alongside one-hour data for a year.
+//
+// Samples added to a Multi are consolidated into the finest archive. Each time
+// the finest archive finishes a timebox, that timebox is rolled up into the
+// coarser archives, so their most recent timebox lags the finest archive's a
+// little. A finer timebox that is unknown (including one made unknown by the
+// xfiles factor) counts as unknown time in the coarser timebox it is rolled
+// into, and the xfiles factor is applied again there.
+//
+// Like a Db, a Multi is safe for concurrent use by multiple goroutines.
+type Multi struct {
+	mu       sync.Mutex // serializes adding samples
+	archives []*Db      // ordered from finest to coarsest resolution
+}
+
+// NewMulti creates and returns a new Multi keeping the given archives. The
+// resolution of every archive must be a multiple of the finest resolution.
+// The options are applied to every archive.
+func NewMulti(archives []Archive, opts ...Option) *Multi {
+	if len(archives) == 0 {
+		panic("No archives given.")
+	}
+
+	m := new(Multi)
+	for _, a := range archives {
+		if a.Res <= 0 || a.Capacity <= 0 {
+			panic("Archive resolution and capacity must be positive.")
+		}
+		m.archives = append(m.archives, New(a.Res, a.Capacity, opts...))
+	}
+	sort.SliceStable(m.archives, func(i, j int) bool {
+		return m.archives[i].res < m.archives[j].res
+	})
+	for _, db := range m.archives {
+		if db.res%m.archives[0].res != 0 {
+			panic("Archive resolutions must be multiples of the finest one.")
+		}
+	}
+	return m
+}
+
+// Archives returns the archives of the Multi, ordered from finest to coarsest
+// resolution. Each may be read using the usual Db methods, but samples should
+// only be added through the Multi.
+func (m *Multi) Archives() []*Db {
+	return append([]*Db(nil), m.archives...)
+}
+
+// Add will add value v to every archive at the current time, as told by the
+// clock of the archives (see WithClock).
+func (m *Multi) Add(v float32) error {
+	return m.AddAt(v, clockOrSystem(m.archives[0].clock).Now())
+}
+
+// AddAt will add value v to every archive at time t. If the sample can't be
+// applied, AddAt returns the same errors as Db.AddAt and no archive is
+// modified.
+func (m *Multi) AddAt(v float32, t time.Time) error {
+	return m.addAt(float64(v), uint64(math.Max(0, float64(v))), t)
+}
+
+// AddCounter will add the counter reading v to every archive at the current
+// time, as told by the clock of the archives.
+func (m *Multi) AddCounter(v uint64) error {
+	return m.AddCounterAt(v, clockOrSystem(m.archives[0].clock).Now())
+}
+
+// AddCounterAt is like AddAt, but takes an integer reading; see
+// Db.AddCounterAt.
+func (m *Multi) AddCounterAt(v uint64, t time.Time) error {
+	return m.addAt(float64(v), v, t)
+}
+
+// addAt implements AddAt for a raw reading; see Db.addAt.
+func (m *Multi) addAt(raw float64, count uint64, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fine := m.archives[0]
+	fine.mu.Lock()
+
+	// A sample too old for the finest archive may still be within the
+	// window of a coarser one, in which case it's merely out of order.
+	err := fine.check(raw, t)
+	if err == ErrBeforeRetention {
+		for _, db := range m.archives[1:] {
+			// The coarser archives are only changed while holding
+			// m.mu, so they can be read without their own locks.
+			if db.tail != -1 && !t.Before(db.retained()) {
+				err = ErrOutOfOrder
+				break
+			}
+		}
+	}
+	if err != nil {
+		fine.mu.Unlock()
+		return err
+	}
+
+	// Adding goes through add so the finest archive counts the change and
+	// writes it to any file or log it has; an error doing so leaves the
+	// archive updated, so the roll-up carries on regardless
+	moves := fine.moves
+	empty := fine.tail == -1
+	err = fine.add(raw, count, t, true)
+	if empty {
+		fine.mu.Unlock()
+		return err
+	}
+
+	// Collect each timebox the finest archive moved on from, to be rolled
+	// into the coarser archives. Any that have already been overwritten in
+	// the finest archive's ring end up as unknown time.
+	type finished struct {
+		start time.Time
+		stop  time.Time
+		vals  []float32
+	}
+	var boxes []finished
+	start := fine.currentStart
+	for j := 1; j <= fine.moves-moves && j < fine.length(); j++ {
+		stop := start
+		start = fine.step(start, -1)
+		vals := append([]float32(nil), fine.box(fine.slot(fine.length()-1-j))...)
+		boxes = append(boxes, finished{start, stop, vals})
+	}
+	fine.mu.Unlock()
+
+	for _, db := range m.archives[1:] {
+		db.mu.Lock()
+		for j := len(boxes) - 1; j >= 0; j-- {
+			db.rollUp(boxes[j].start, boxes[j].stop, boxes[j].vals)
+		}
+		db.mu.Unlock()
+	}
+	return err
+}
+
+// rollUp merges the finished timebox from start to stop of a finer archive,
+// holding vals, into the database.
+func (db *Db) rollUp(start, stop time.Time, vals []float32) {
+	if db.tail == -1 {
+		db.tail = 0
+		db.head = 0
+		db.currentStart, db.currentStop = db.boxTime(start)
+		db.clearBox()
+		db.lastEntry = db.currentStart
+		db.unknownTime = 0
+	}
+
+	// Catch up to the timebox start lives in
+	for !start.Before(db.currentStop) {
+		db.unknownTime += db.currentStop.Sub(db.lastEntry)
+		db.lastEntry = db.currentStop
+		db.moveForward()
+	}
+	db.unknownTime += start.Sub(db.lastEntry)
+
+	known := false
+	for _, v := range vals {
+		known = known || !IsUnknown(v)
+	}
+	if known {
+		prevFill := float32(db.known().Seconds())
+		curDuration := float32(stop.Sub(start).Seconds())
+		for k, cf := range db.cfs {
+			e := &db.box(db.tail)[k]
+			*e = cf.merge(*e, vals[k], prevFill, curDuration)
+		}
+	} else {
+		db.unknownTime += stop.Sub(start)
+	}
+	db.lastEntry = stop
+	db.updates++
+}
+
+// Fetch returns the data between start and end, as Db.Fetch does, from the
+// finest archive whose data reaches back to start. If no archive reaches back
+// that far, the archive reaching back furthest is used.
+func (m *Multi) Fetch(start, end time.Time) []Point {
+	return m.pick(start).Fetch(start, end)
+}
+
+// FetchCF is like Fetch, but returns values consolidated by cf.
+func (m *Multi) FetchCF(cf Consolidation, start, end time.Time) []Point {
+	return m.pick(start).FetchCF(cf, start, end)
+}
+
+// pick returns the archive to read data starting at start from.
+func (m *Multi) pick(start time.Time) *Db {
+	best := m.archives[0]
+	var bestOldest time.Time
+	for _, db := range m.archives {
+		db.mu.RLock()
+		empty := db.tail == -1
+		var oldest time.Time
+		if !empty {
+			oldest = db.oldest()
+		}
+		db.mu.RUnlock()
+
+		if empty {
+			continue
+		}
+		if !oldest.After(start) {
+			return db
+		}
+		if bestOldest.IsZero() || oldest.Before(bestOldest) {
+			best, bestOldest = db, oldest
+		}
+	}
+	return best
+}
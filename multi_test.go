@@ -0,0 +1,205 @@
+/*
+ * File:	multi_test.go
+ *
+ * Implements tests for the multi.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiFetch(t *testing.T) {
+	m := NewMulti([]Archive{{120 * time.Second, 10}, {30 * time.Second, 4}})
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i <= 20; i++ {
+		if err := m.AddAt(float32(i), base.Add(time.Duration(i*30)*time.Second)); err != nil {
+			t.Fatalf("m.AddAt returned %v", err)
+		}
+	}
+
+	archives := m.Archives()
+	if archives[0].Res() != 30*time.Second || archives[1].Res() != 120*time.Second {
+		t.Fatalf("archives not ordered finest first")
+	}
+
+	var tests = []struct {
+		start time.Duration // offset from base
+		res   time.Duration // expected spacing of the points
+		n     int           // expected number of points
+	}{
+		{9 * time.Minute, 30 * time.Second, 3},
+		{8*time.Minute + 30*time.Second, 30 * time.Second, 4},
+		{6 * time.Minute, 2 * time.Minute, 2},
+		{-time.Hour, 2 * time.Minute, 10},
+	}
+
+	for i, tt := range tests {
+		points := m.Fetch(base.Add(tt.start), base.Add(time.Hour))
+		if len(points) != tt.n {
+			t.Errorf("Test %d: got %d points, expected %d", i, len(points), tt.n)
+			continue
+		}
+		if d := points[1].Time.Sub(points[0].Time); d != tt.res {
+			t.Errorf("Test %d: points are %v apart, expected %v", i, d, tt.res)
+		}
+	}
+}
+
+func TestMultiRejects(t *testing.T) {
+	m := NewMulti([]Archive{{30 * time.Second, 4}, {120 * time.Second, 10}})
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	m.AddAt(1, base)
+	m.AddAt(2, base.Add(10*time.Minute))
+
+	var before []float32
+	for _, db := range m.Archives() {
+		before = append(before, db.Get(db.Len()-1))
+	}
+
+	// Too old for the fine archive, but the coarse one still covers it
+	if err := m.AddAt(3, base.Add(5*time.Minute)); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("m.AddAt returned %v, expected ErrOutOfOrder", err)
+	}
+	if err := m.AddAt(3, base.Add(-time.Hour)); !errors.Is(err, ErrBeforeRetention) {
+		t.Errorf("m.AddAt returned %v, expected ErrBeforeRetention", err)
+	}
+	for i, db := range m.Archives() {
+		if x := db.Get(db.Len() - 1); !sameValue(x, before[i]) {
+			t.Errorf("rejected sample changed archive with res %d: got %v, expected %v",
+				db.Res(), x, before[i])
+		}
+	}
+}
+
+func TestMultiRollUp(t *testing.T) {
+	m := NewMulti([]Archive{{30 * time.Second, 10}, {120 * time.Second, 10}},
+		WithConsolidation(Average, Max), WithHeartbeat(time.Minute), WithXFF(0.5))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	var data = []struct {
+		offset time.Duration
+		v      float32
+	}{
+		// 08:00 - 08:02: fully known
+		{0, 1}, {30 * time.Second, 2}, {60 * time.Second, 3}, {90 * time.Second, 4},
+		{120 * time.Second, 5},
+		// 08:02 - 08:04: 08:02:30 - 08:04:00 unknown (stale), so 3 of
+		// the 4 fine timeboxes are unknown
+		{150 * time.Second, 6}, {240 * time.Second, 7},
+		// 08:04 - 08:06: 08:04:30 - 08:05:35 is unknown, so 2 of the
+		// 4 fine timeboxes are, which the xfiles factor still allows
+		{270 * time.Second, 8}, {335 * time.Second, 9}, {345 * time.Second, 10},
+		{360 * time.Second, 10},
+	}
+	for _, d := range data {
+		if err := m.AddAt(d.v, base.Add(d.offset)); err != nil {
+			t.Fatalf("m.AddAt returned %v", err)
+		}
+	}
+
+	coarse := m.Archives()[1]
+	var expected = []struct {
+		avg, max float32
+	}{
+		{(2 + 3 + 4 + 5) / 4.0, 4},
+		{unknown, unknown},
+		{(8 + 10) / 2.0, 10},
+	}
+	if coarse.Len() != len(expected) {
+		t.Fatalf("coarse.Len() = %v, want %v", coarse.Len(), len(expected))
+	}
+	for i, want := range expected {
+		if x := coarse.Get(i); !sameValue(x, want.avg) {
+			t.Errorf("coarse.Get(%d) = %v, want %v", i, x, want.avg)
+		}
+		if x := coarse.GetCF(i, Max); !sameValue(x, want.max) {
+			t.Errorf("coarse.GetCF(%d, Max) = %v, want %v", i, x, want.max)
+		}
+	}
+}
+
+// Every archive of a Multi counts its changes, so each can be autosaved
+func TestMultiAutosave(t *testing.T) {
+	m := NewMulti([]Archive{{30 * time.Second, 10}, {120 * time.Second, 10}})
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	dir := t.TempDir()
+
+	var savers []*Autosaver
+	for i, db := range m.Archives() {
+		a := AutosaveDb(db, filepath.Join(dir, fmt.Sprint(i)), time.Hour, func(err error) {
+			t.Errorf("autosave failed: %v", err)
+		})
+		defer a.Close()
+		a.Save()
+		savers = append(savers, a)
+	}
+	for i := 0; i < 20; i++ {
+		m.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+	for i, db := range m.Archives() {
+		if err := savers[i].Save(); err != nil {
+			t.Fatalf("Save of archive %d returned %v", i, err)
+		}
+		loaded := new(Db)
+		if err := loaded.LoadFile(filepath.Join(dir, fmt.Sprint(i))); err != nil || !loaded.equals(db) {
+			t.Errorf("LoadFile of archive %d returned %v, or a different database", i, err)
+		}
+	}
+}
+
+// TestMultiConcurrentAccess is mostly of use when run with the race detector
+// (go test -race).
+func TestMultiConcurrentAccess(t *testing.T) {
+	m := NewMulti([]Archive{{30 * time.Second, 10}, {120 * time.Second, 10}})
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			m.AddAt(float32(i), base.Add(time.Duration(i)*time.Second))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			m.Fetch(base, base.Add(time.Hour))
+			for _, db := range m.Archives() {
+				db.Len()
+			}
+		}
+	}()
+	wg.Wait()
+}
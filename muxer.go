@@ -32,30 +32,242 @@
 
 package goaround
 
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+import "sync"
 import "time"
 
+// MuxError is returned by Mux.Add and Mux.AddAt when one or more of the
+// databases in the Mux rejected a sample. Databases that accepted the sample
+// are still updated.
+type MuxError struct {
+	Errs map[string]error // the error returned by each rejecting database
+}
+
+func (e *MuxError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, e.Errs[name])
+	}
+	return fmt.Sprintf("goaround: sample rejected by %d database(s): %s",
+		len(names), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the individual database errors so that errors.Is and
+// errors.As can see through a MuxError.
+func (e *MuxError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// A Mux is a registry of named databases, which also allows adding a sample
+// to all of them at once. The Mux holds the very *Db values it is given, so
+// they may still be read (or added to) directly.
+//
+// A Mux is safe for concurrent use by multiple goroutines.
 type Mux struct {
-	dbs map[string]Db
+	mu     sync.RWMutex // guards dbs, lazy, saved and wal
+	dbs    map[string]*Db
+	lazy   map[string]string    // file of each database saved by SaveDir but not yet loaded
+	saved  map[string]savedFile // where and as of when each database was last saved
+	wal    *WAL                 // write-ahead log of accepted samples, if any
+	saveMu sync.Mutex           // serializes SaveDir
+	logMu  sync.RWMutex         // held by AddAt, and by CheckpointDir to pause it
+	clock  Clock                // tells the time for Add; nil for the system clock
 }
 
-func NewMux() *Mux {
+// A MuxOption configures optional behavior of a Mux when passed to NewMux or
+// LoadDir.
+type MuxOption func(*Mux)
+
+// NewMux creates and returns a new, empty Mux.
+func NewMux(opts ...MuxOption) *Mux {
 	mux := new(Mux)
-	mux.dbs = make(map[string]Db)
+	mux.dbs = make(map[string]*Db)
+	mux.lazy = make(map[string]string)
+	mux.saved = make(map[string]savedFile)
+	for _, opt := range opts {
+		opt(mux)
+	}
 	return mux
 }
 
-func (mux *Mux) AddDb(name string, db Db) {
+// AddDb adds db to the Mux under name, replacing any database already there.
+func (mux *Mux) AddDb(name string, db *Db) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
 	mux.dbs[name] = db
+	delete(mux.lazy, name)
 }
 
-func (mux *Mux) Add(v float32) {
-	for _, db := range mux.dbs {
-		db.Add(v)
+// Get returns the database named name, and whether there was one. A database
+// that fails to load (see Load) is reported as not there.
+func (mux *Mux) Get(name string) (*Db, bool) {
+	db, err := mux.Load(name)
+	return db, db != nil && err == nil
+}
+
+// Load is like Get, but for a Mux loaded by LoadDir, whose databases are only
+// loaded from their files as they are first used, it also returns any error
+// loading the database. Load returns a nil database and a nil error if there
+// is no database named name.
+func (mux *Mux) Load(name string) (*Db, error) {
+	mux.mu.RLock()
+	db, path := mux.dbs[name], mux.lazy[name]
+	mux.mu.RUnlock()
+
+	if db != nil || path == "" {
+		return db, nil
+	}
+	return mux.load(name, path)
+}
+
+// load loads the database named name from its file, path, and puts it in the
+// Mux, unless it has since been loaded, replaced or removed.
+func (mux *Mux) load(name, path string) (*Db, error) {
+	db := &Db{clock: mux.clock}
+	if err := db.LoadFile(path); err != nil {
+		return nil, err
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.lazy[name] != path {
+		return mux.dbs[name], nil
 	}
+	delete(mux.lazy, name)
+	mux.dbs[name] = db
+	mux.saved[name] = savedFile{path, db, db.updates}
+	return db, nil
+}
+
+// Remove removes the database named name from the Mux, and reports whether
+// there was one.
+func (mux *Mux) Remove(name string) bool {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	_, ok := mux.dbs[name]
+	_, lazy := mux.lazy[name]
+	delete(mux.dbs, name)
+	delete(mux.lazy, name)
+	return ok || lazy
+}
+
+// Len returns the number of databases in the Mux.
+func (mux *Mux) Len() int {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	return len(mux.dbs) + len(mux.lazy)
 }
 
-func (mux *Mux) AddAt(v float32, t time.Time) {
-	for _, db := range mux.dbs {
-		db.AddAt(v, t)
+// Names returns the names of the databases in the Mux, in sorted order.
+func (mux *Mux) Names() []string {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	names := make([]string, 0, len(mux.dbs)+len(mux.lazy))
+	for name := range mux.dbs {
+		names = append(names, name)
+	}
+	for name := range mux.lazy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Range calls f for each database in the Mux, in order of name, stopping early
+// if f returns false. Range works from the set of databases in the Mux when it
+// is called, so f is free to add or remove databases. Databases that fail to
+// load (see Load) are skipped.
+func (mux *Mux) Range(f func(name string, db *Db) bool) {
+	for _, name := range mux.Names() {
+		db, err := mux.Load(name)
+		if db == nil || err != nil {
+			continue
+		}
+		if !f(name, db) {
+			return
+		}
+	}
+}
+
+// Add adds v at the current time, as told by the Mux's clock (see
+// WithMuxClock), to every database in the Mux; see AddAt.
+func (mux *Mux) Add(v float32) error {
+	return mux.AddAt(v, clockOrSystem(mux.clock).Now())
+}
+
+// AddAt adds v at time t to every database in the Mux. If any database
+// rejects the sample, a *MuxError naming those databases is returned.
+func (mux *Mux) AddAt(v float32, t time.Time) error {
+	mux.logMu.RLock()
+	defer mux.logMu.RUnlock()
+
+	var merr *MuxError
+
+	// Every database is needed, so load those that haven't been yet
+	mux.mu.RLock()
+	lazy := make([]string, 0, len(mux.lazy))
+	for name := range mux.lazy {
+		lazy = append(lazy, name)
+	}
+	mux.mu.RUnlock()
+	for _, name := range lazy {
+		if _, err := mux.Load(name); err != nil {
+			if merr == nil {
+				merr = &MuxError{make(map[string]error)}
+			}
+			merr.Errs[name] = err
+		}
+	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	for name, db := range mux.dbs {
+		if err := mux.addTo(name, db, v, t); err != nil {
+			if merr == nil {
+				merr = &MuxError{make(map[string]error)}
+			}
+			merr.Errs[name] = err
+		}
+	}
+	if merr != nil {
+		return merr
+	}
+	return nil
+}
+
+// addTo adds v at time t to db, which is in the Mux under name, logging the
+// sample to the Mux's write-ahead log if the database accepts it.
+func (mux *Mux) addTo(name string, db *Db, v float32, t time.Time) error {
+	raw, count := float64(v), uint64(math.Max(0, float64(v)))
+
+	if mux.wal != nil {
+		if err := checkWALTime(t); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.add(raw, count, t, true); err != nil {
+		return err
+	}
+	if mux.wal != nil {
+		return mux.wal.append(name, raw, count, t)
 	}
+	return nil
 }
@@ -0,0 +1,133 @@
+/*
+ * File:	muxer_test.go
+ *
+ * Implements tests for the muxer.go functionality.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMuxErrors(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:01Z")
+	fresh := New(30*time.Second, 10)
+	stale := New(30*time.Second, 10)
+	stale.AddAt(1, base.Add(time.Minute))
+
+	mux := NewMux()
+	mux.AddDb("fresh", fresh)
+	mux.AddDb("stale", stale)
+
+	err := mux.AddAt(5, base)
+	var merr *MuxError
+	if !errors.As(err, &merr) {
+		t.Fatalf("mux.AddAt returned %v, expected a *MuxError", err)
+	}
+	if len(merr.Errs) != 1 || merr.Errs["stale"] == nil {
+		t.Errorf("MuxError names %v, expected only \"stale\"", merr.Errs)
+	}
+	if !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("errors.Is(%v, ErrOutOfOrder) = false", err)
+	}
+
+	if err := mux.AddAt(5, base.Add(2*time.Minute)); err != nil {
+		t.Errorf("mux.AddAt returned %v, expected nil", err)
+	}
+}
+
+// TestMuxConcurrentAccess is mostly of use when run with the race detector
+// (go test -race).
+func TestMuxConcurrentAccess(t *testing.T) {
+	mux := NewMux()
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			mux.AddAt(float32(i), base.Add(time.Duration(i)*time.Second))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			mux.AddDb(fmt.Sprint(i), New(30*time.Second, 10))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMuxRegistry(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	a := New(30*time.Second, 10)
+	b := New(60*time.Second, 10)
+
+	mux := NewMux()
+	mux.AddDb("b", b)
+	mux.AddDb("a", a)
+	mux.AddDb("c", New(30*time.Second, 10))
+	mux.AddAt(5, base)
+	mux.AddAt(7, base.Add(time.Minute))
+
+	// The databases we hold should see every update made through the Mux
+	if a.Len() != 3 || a.Get(2) != 7 {
+		t.Errorf("database a out of sync with Mux: len %v", a.Len())
+	}
+	if db, ok := mux.Get("b"); !ok || db != b {
+		t.Errorf("mux.Get(\"b\") = %p, %v; want %p, true", db, ok, b)
+	}
+
+	if !mux.Remove("c") || mux.Remove("c") {
+		t.Errorf("mux.Remove(\"c\") didn't report removal correctly")
+	}
+	if _, ok := mux.Get("c"); ok {
+		t.Errorf("mux.Get(\"c\") found a removed database")
+	}
+
+	names := mux.Names()
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" || mux.Len() != 2 {
+		t.Errorf("mux.Names() = %v, want [a b]", names)
+	}
+
+	var seen []string
+	mux.Range(func(name string, db *Db) bool {
+		seen = append(seen, name)
+		mux.Remove(name)
+		return true
+	})
+	if len(seen) != 2 || seen[0] != "a" || seen[1] != "b" || mux.Len() != 0 {
+		t.Errorf("mux.Range visited %v, want [a b]", seen)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * File:	muxstore.go
+ *
+ * Implements saving a Mux to a directory and loading it back.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*****************************************************************************/
+// A Mux is saved to a directory holding a file for each database, in the
+// format written by Db.SaveFile, and a manifest naming the file of each
+// database. Each save writes its databases to new files, named after the
+// generation of the save, and then replaces the manifest. Replacing the
+// manifest is what makes the save take effect, so a crash part way through
+// leaves the previous save as it was. Only once the new manifest is in place
+// are the files the old one named removed.
+//
+// Databases that haven't changed since they were last saved to the directory
+// keep their files from that save, so each save only writes what changed.
+/*****************************************************************************/
+
+const manifestName = "manifest.json"
+
+// savedFile records the file a database was saved to, and the database's
+// update count when it was.
+type savedFile struct {
+	path    string
+	db      *Db
+	updates uint64
+}
+
+type manifest struct {
+	Generation int               `json:"generation"`
+	Files      map[string]string `json:"files"` // the file of each database, by name
+}
+
+// SaveDir saves every database in the Mux to directory dir, creating it if
+// need be, and replacing whatever the Mux saved there before. Either all of
+// the databases are saved or, if SaveDir fails or the system crashes part way
+// through, the directory still holds the previous save. Only databases that
+// changed since they were last saved to dir are written, and nothing at all is
+// written if none did.
+//
+// Each database is saved as it is at the moment it is reached; SaveDir doesn't
+// stop samples being added to the Mux in the meantime.
+func (mux *Mux) SaveDir(dir string) error {
+	mux.saveMu.Lock()
+	defer mux.saveMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	old, err := readManifest(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		old = &manifest{}
+	} else if err != nil {
+		return err
+	}
+
+	// Clear away anything left by a save that didn't finish
+	if err := removeUnused(dir, old); err != nil {
+		return err
+	}
+
+	mux.mu.RLock()
+	dbs := make(map[string]*Db, len(mux.dbs))
+	for name, db := range mux.dbs {
+		dbs[name] = db
+	}
+	lazy := make(map[string]string, len(mux.lazy))
+	for name, path := range mux.lazy {
+		lazy[name] = path
+	}
+	saved := make(map[string]savedFile, len(mux.saved))
+	for name, s := range mux.saved {
+		saved[name] = s
+	}
+	mux.mu.RUnlock()
+
+	m := &manifest{Generation: old.Generation + 1, Files: make(map[string]string)}
+	write := func(name string, data []byte) error {
+		file := fmt.Sprintf("%d-%d.gar", m.Generation, len(m.Files))
+		f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		m.Files[name] = file
+		return writeSynced(f, data)
+	}
+
+	// Databases not yet loaded are unchanged since they were saved, so
+	// their files can be kept, or copied if they are elsewhere
+	for name, path := range lazy {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			m.Files[name] = filepath.Base(path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = write(name, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	written := make(map[string]savedFile)
+	for name, db := range dbs {
+		updates := db.changes()
+		if s, ok := saved[name]; ok && s.db == db && s.updates == updates &&
+			filepath.Dir(s.path) == filepath.Clean(dir) {
+			m.Files[name] = filepath.Base(s.path)
+			continue
+		}
+
+		b, err := db.GobEncode()
+		if err == nil {
+			err = write(name, wrapSaved(b))
+		}
+		if err != nil {
+			return err
+		}
+		written[name] = savedFile{filepath.Join(dir, m.Files[name]), db, updates}
+	}
+	if len(written) == 0 && maps.Equal(m.Files, old.Files) {
+		return nil
+	}
+	syncDir(dir)
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestName), data); err != nil {
+		return err
+	}
+
+	mux.mu.Lock()
+	for name, s := range written {
+		mux.saved[name] = s
+	}
+	for name := range mux.saved {
+		if _, ok := m.Files[name]; !ok {
+			delete(mux.saved, name)
+		}
+	}
+	mux.mu.Unlock()
+
+	return removeUnused(dir, m)
+}
+
+// LoadDir returns a Mux holding the databases saved to directory dir by
+// SaveDir. The databases are only loaded from their files as they are first
+// used, so loading a Mux of many databases is quick, and errors loading a
+// database are reported when it is used; see Load. The options are applied to
+// the Mux as by NewMux.
+func LoadDir(dir string, opts ...MuxOption) (*Mux, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := NewMux(opts...)
+	for name, file := range m.Files {
+		mux.lazy[name] = filepath.Join(dir, file)
+	}
+	return mux, nil
+}
+
+// readManifest reads the manifest of the Mux saved to directory dir.
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, manifestName), ErrBadFile)
+	}
+	for _, file := range m.Files {
+		if file != filepath.Base(file) {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, manifestName), ErrBadFile)
+		}
+	}
+	return &m, nil
+}
+
+// removeUnused removes the database files in directory dir that m doesn't
+// name, along with any temporary file left by failing to write a manifest.
+func removeUnused(dir string, m *manifest) error {
+	used := make(map[string]bool, len(m.Files))
+	for _, file := range m.Files {
+		used[file] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var gen, i int
+		_, err := fmt.Sscanf(e.Name(), "%d-%d.gar", &gen, &i)
+		dbFile := err == nil && e.Name() == fmt.Sprintf("%d-%d.gar", gen, i)
+		if !(dbFile && !used[e.Name()]) && !strings.HasPrefix(e.Name(), manifestName+".tmp") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
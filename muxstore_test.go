@@ -0,0 +1,198 @@
+/*
+ * File:	muxstore_test.go
+ *
+ * Implements tests for the muxstore.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dirFiles returns the names of the files in dir, sorted.
+func dirFiles(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMuxSaveDir(t *testing.T) {
+	dir := t.TempDir()
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	mux := NewMux()
+	mux.AddDb("a", New(30*time.Second, 5))
+	mux.AddDb("b/c", New(60*time.Second, 5, WithConsolidation(Max)))
+	mux.AddDb("d", New(120*time.Second, 5))
+	for i := 0; i < 10; i++ {
+		mux.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+
+	if err := mux.SaveDir(dir); err != nil {
+		t.Fatalf("mux.SaveDir returned %v", err)
+	}
+	want := []string{"1-0.gar", "1-1.gar", "1-2.gar", "manifest.json"}
+	if files := dirFiles(dir); !slices.Equal(files, want) {
+		t.Errorf("directory holds %v, expected %v", files, want)
+	}
+
+	loaded, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("LoadDir returned %v", err)
+	}
+	if loaded.Len() != 3 || !slices.Equal(loaded.Names(), mux.Names()) {
+		t.Errorf("loaded mux has databases %v", loaded.Names())
+	}
+	if len(loaded.lazy) != 3 {
+		t.Errorf("LoadDir loaded %d databases up front", 3-len(loaded.lazy))
+	}
+	a, ok := loaded.Get("a")
+	orig, _ := mux.Get("a")
+	if !ok || !a.equals(orig) {
+		t.Errorf("loaded database a does not match")
+	}
+	if len(loaded.lazy) != 2 {
+		t.Errorf("Get loaded %d databases, expected 1", 2-len(loaded.lazy))
+	}
+
+	// Saving again keeps the files of the databases that are unchanged,
+	// loaded or not, and removes the rest
+	old, _ := readManifest(dir)
+	a.AddAt(42, base.Add(time.Hour))
+	loaded.Get("d")
+	if err := loaded.SaveDir(dir); err != nil {
+		t.Fatalf("loaded.SaveDir returned %v", err)
+	}
+	m, _ := readManifest(dir)
+	if m.Generation != 2 || !strings.HasPrefix(m.Files["a"], "2-") ||
+		m.Files["b/c"] != old.Files["b/c"] || m.Files["d"] != old.Files["d"] {
+		t.Errorf("second save wrote manifest %v", m)
+	}
+	want = []string{m.Files["a"], m.Files["b/c"], m.Files["d"], "manifest.json"}
+	sort.Strings(want)
+	if files := dirFiles(dir); !slices.Equal(files, want) {
+		t.Errorf("directory holds %v after second save, expected %v", files, want)
+	}
+
+	// Saving elsewhere copies the files of databases not yet loaded
+	other := filepath.Join(t.TempDir(), "other")
+	loaded, _ = LoadDir(dir)
+	if err := loaded.SaveDir(other); err != nil {
+		t.Fatalf("loaded.SaveDir returned %v", err)
+	}
+	again, _ := LoadDir(other)
+	mux.Range(func(name string, db *Db) bool {
+		if name == "a" {
+			db.AddAt(42, base.Add(time.Hour))
+		}
+		if got, ok := again.Get(name); !ok || !got.equals(db) {
+			t.Errorf("database %s does not match after saving elsewhere", name)
+		}
+		return true
+	})
+
+	// Adding to a loaded Mux loads every database first
+	loaded, _ = LoadDir(dir)
+	if err := loaded.AddAt(7, base.Add(2*time.Hour)); err != nil || len(loaded.lazy) != 0 {
+		t.Errorf("loaded.AddAt returned %v, leaving %d databases unloaded", err, len(loaded.lazy))
+	}
+}
+
+func TestMuxSaveDirRecovery(t *testing.T) {
+	dir := t.TempDir()
+	mux := NewMux()
+	mux.AddDb("a", New(30*time.Second, 5))
+	mux.AddDb("b", New(30*time.Second, 5))
+	if err := mux.SaveDir(dir); err != nil {
+		t.Fatalf("mux.SaveDir returned %v", err)
+	}
+
+	// A save that crashed before writing its manifest
+	os.WriteFile(filepath.Join(dir, "2-0.gar"), []byte("partial"), 0666)
+	os.WriteFile(filepath.Join(dir, "manifest.json.tmp1234"), []byte("{"), 0666)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0666)
+	if _, err := LoadDir(dir); err != nil {
+		t.Errorf("LoadDir after crashed save returned %v", err)
+	}
+	if err := mux.SaveDir(dir); err != nil {
+		t.Fatalf("mux.SaveDir after crashed save returned %v", err)
+	}
+	// Nothing changed, so nothing is written, but the leftovers are gone
+	want := []string{"1-0.gar", "1-1.gar", "manifest.json", "notes.txt"}
+	if files := dirFiles(dir); !slices.Equal(files, want) {
+		t.Errorf("directory holds %v, expected %v", files, want)
+	}
+
+	// Only the database that changed is written again
+	old, _ := readManifest(dir)
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	b, _ := mux.Get("b")
+	b.AddAt(5, base)
+	if err := mux.SaveDir(dir); err != nil {
+		t.Fatalf("mux.SaveDir after change returned %v", err)
+	}
+	m, _ := readManifest(dir)
+	if m.Generation != 2 || m.Files["a"] != old.Files["a"] ||
+		!strings.HasPrefix(m.Files["b"], "2-") {
+		t.Errorf("save after change wrote manifest %v", m)
+	}
+	want = []string{old.Files["a"], m.Files["b"], "manifest.json", "notes.txt"}
+	sort.Strings(want)
+	if files := dirFiles(dir); !slices.Equal(files, want) {
+		t.Errorf("directory holds %v after change, expected %v", files, want)
+	}
+
+	// A damaged database file is reported when the database is used
+	os.WriteFile(filepath.Join(dir, m.Files["b"]), []byte("garbage"), 0666)
+	loaded, _ := LoadDir(dir)
+	if _, err := loaded.Load("b"); !errors.Is(err, ErrBadFile) {
+		t.Errorf("loaded.Load of damaged file returned %v, expected ErrBadFile", err)
+	}
+	if _, ok := loaded.Get("b"); ok {
+		t.Errorf("loaded.Get returned damaged database")
+	}
+	if _, ok := loaded.Get("a"); !ok {
+		t.Errorf("loaded.Get failed for undamaged database")
+	}
+
+	os.WriteFile(filepath.Join(dir, manifestName), []byte("{"), 0666)
+	if _, err := LoadDir(dir); !errors.Is(err, ErrBadFile) {
+		t.Errorf("LoadDir of damaged manifest returned %v, expected ErrBadFile", err)
+	}
+}
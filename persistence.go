@@ -34,8 +34,13 @@ package goaround
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -49,9 +54,146 @@ import (
 // This seems pretty hacky, but it's the best idea I have at the moment that
 // doesn't end up involve implementing even more code and not just relying on
 // the library functions to encode and decode stuff.
+//
+// Each time the format changes, the version number goes up, the struct for
+// the previous version is frozen under a new name, and that version gets an
+// upgrade to the next version's struct and a downgrade back from it, which
+// make up its entry in gobSteps. Data of any version then decodes into the
+// current struct, and the current struct can be encoded as any version that
+// can represent it.
 /*****************************************************************************/
 
+// gobDb is the current version of the gob format.
 type gobDb struct {
+	Res          time.Duration
+	Entries      []float32 // unknown entries are NaN, which gob keeps intact
+	Packed       []byte    // the entries compressed by packEntries, instead
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+	XFF          float64
+	Offset       time.Duration
+	Location     string   // name of the location, empty for UTC
+	Calendar     Calendar // unit of the calendar each timebox covers, if any
+}
+
+const gobDbGobVersion byte = 9
+
+// gobDbV8 is version 8 of the gob format, which had no calendar units.
+type gobDbV8 struct {
+	Res          time.Duration
+	Entries      []float32
+	Packed       []byte
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+	XFF          float64
+	Offset       time.Duration
+	Location     string
+}
+
+func (d *gobDbV8) upgrade() *gobDb {
+	return &gobDb{d.Res, d.Entries, d.Packed, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF, d.Offset, d.Location, 0}
+}
+
+func downgradeV8(d *gobDb) (*gobDbV8, error) {
+	if d.Calendar != 0 {
+		return nil, errors.New("goaround: gob format versions before 9 have no calendar units")
+	}
+	return &gobDbV8{d.Res, d.Entries, d.Packed, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF, d.Offset, d.Location}, nil
+}
+
+// gobDbV7 is version 7 of the gob format, which had no offset or location.
+type gobDbV7 struct {
+	Res          time.Duration
+	Entries      []float32
+	Packed       []byte
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+	XFF          float64
+}
+
+func (d *gobDbV7) upgrade() *gobDbV8 {
+	return &gobDbV8{d.Res, d.Entries, d.Packed, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF, 0, ""}
+}
+
+func downgradeV7(d *gobDbV8) (*gobDbV7, error) {
+	if d.Offset != 0 || d.Location != "" {
+		return nil, errors.New("goaround: gob format versions before 8 need timeboxes aligned to the epoch in UTC")
+	}
+	return &gobDbV7{d.Res, d.Entries, d.Packed, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF}, nil
+}
+
+// gobDbV6 is version 6 of the gob format, which gave the resolution in whole
+// seconds.
+type gobDbV6 struct {
+	Res          int
+	Entries      []float32
+	Packed       []byte
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+	XFF          float64
+}
+
+func (d *gobDbV6) upgrade() *gobDbV7 {
+	return &gobDbV7{time.Duration(d.Res) * time.Second, d.Entries, d.Packed,
+		d.Head, d.Tail, d.CurrentStart, d.CurrentStop, d.LastEntry, d.Cfs,
+		d.Kind, d.LastRaw, d.LastCount, d.UnknownTime, d.Heartbeat, d.XFF}
+}
+
+func downgradeV6(d *gobDbV7) (*gobDbV6, error) {
+	if d.Res%time.Second != 0 {
+		return nil, errors.New("goaround: gob format versions before 7 need a resolution of whole seconds")
+	}
+	return &gobDbV6{int(d.Res / time.Second), d.Entries, d.Packed, d.Head,
+		d.Tail, d.CurrentStart, d.CurrentStop, d.LastEntry, d.Cfs, d.Kind,
+		d.LastRaw, d.LastCount, d.UnknownTime, d.Heartbeat, d.XFF}, nil
+}
+
+// gobDbV5 is version 5 of the gob format, which had no compression.
+type gobDbV5 struct {
 	Res          int
 	Entries      []float32
 	Head         int
@@ -59,23 +201,280 @@ type gobDb struct {
 	CurrentStart time.Time
 	CurrentStop  time.Time
 	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+	XFF          float64
 }
 
-const gobDbGobVersion byte = 1
+func (d *gobDbV5) upgrade() *gobDbV6 {
+	return &gobDbV6{d.Res, d.Entries, nil, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF}
+}
+
+func downgradeV5(d *gobDbV6) (*gobDbV5, error) {
+	entries, err := unpackGob(d.Entries, d.Packed, d.Cfs)
+	if err != nil {
+		return nil, err
+	}
+	return &gobDbV5{d.Res, entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, d.XFF}, nil
+}
+
+// unpackGob returns the entries of a gob holding entries, or packed, the
+// entries packed by packEntries, for consolidation functions cfs.
+func unpackGob(entries []float32, packed []byte, cfs []Consolidation) ([]float32, error) {
+	if packed == nil {
+		return entries, nil
+	}
+	if len(cfs) == 0 {
+		return nil, errCorrupt
+	}
+	return unpackEntries(packed, len(cfs))
+}
+
+// gobDbV4 is version 4 of the gob format, which had no xfiles factor.
+type gobDbV4 struct {
+	Res          int
+	Entries      []float32
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+	Heartbeat    time.Duration
+}
+
+func (d *gobDbV4) upgrade() *gobDbV5 {
+	return &gobDbV5{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat, 1}
+}
+
+func downgradeV4(d *gobDbV5) (*gobDbV4, error) {
+	if d.XFF != 1 {
+		return nil, errors.New("goaround: gob format versions before 5 have no xfiles factor")
+	}
+	return &gobDbV4{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, d.Heartbeat}, nil
+}
+
+// gobDbV3 is version 3 of the gob format, which had no heartbeat.
+type gobDbV3 struct {
+	Res          int
+	Entries      []float32
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+	Kind         DataSource
+	LastRaw      float64
+	LastCount    uint64
+	UnknownTime  time.Duration
+}
+
+func (d *gobDbV3) upgrade() *gobDbV4 {
+	return &gobDbV4{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime, 0}
+}
+
+func downgradeV3(d *gobDbV4) (*gobDbV3, error) {
+	if d.Heartbeat != 0 {
+		return nil, errors.New("goaround: gob format versions before 4 have no heartbeat")
+	}
+	return &gobDbV3{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, d.Kind, d.LastRaw, d.LastCount,
+		d.UnknownTime}, nil
+}
+
+// gobDbV2 is version 2 of the gob format, which only held gauges and didn't
+// keep the last reading or how much of the current timebox is unknown.
+type gobDbV2 struct {
+	Res          int
+	Entries      []float32
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+	Cfs          []Consolidation
+}
+
+func (d *gobDbV2) upgrade() *gobDbV3 {
+	return &gobDbV3{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs, Gauge, 0, 0, 0}
+}
+
+func downgradeV2(d *gobDbV3) (*gobDbV2, error) {
+	if d.Kind != Gauge || d.UnknownTime != 0 {
+		return nil, errors.New("goaround: gob format versions before 3 need a Gauge with no unknown time")
+	}
+	return &gobDbV2{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, d.Cfs}, nil
+}
+
+// gobDbV1 is version 1 of the gob format, which consolidated by Average alone.
+type gobDbV1 struct {
+	Res          int
+	Entries      []float32
+	Head         int
+	Tail         int
+	CurrentStart time.Time
+	CurrentStop  time.Time
+	LastEntry    time.Time
+}
+
+func (d *gobDbV1) upgrade() *gobDbV2 {
+	return &gobDbV2{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry, []Consolidation{Average}}
+}
+
+func downgradeV1(d *gobDbV2) (*gobDbV1, error) {
+	if len(d.Cfs) != 1 || d.Cfs[0] != Average {
+		return nil, errors.New("goaround: gob format version 1 needs a database consolidated by Average alone")
+	}
+	return &gobDbV1{d.Res, d.Entries, d.Head, d.Tail, d.CurrentStart,
+		d.CurrentStop, d.LastEntry}, nil
+}
+
+// gobStep converts between one version of the gob format and the next. The
+// chain of steps from a version up to the current one reads any version, and
+// the chain back down writes any version.
+type gobStep struct {
+	decode    func(dec *gob.Decoder) (any, error) // reads this version
+	upgrade   func(d any) any                     // converts this version to the next
+	downgrade func(d any) (any, error)            // converts the next version to this
+}
+
+// newGobStep returns the step between version T of the gob format and the
+// next version, N.
+func newGobStep[T, N any](upgrade func(*T) *N, downgrade func(*N) (*T, error)) gobStep {
+	return gobStep{
+		decode: func(dec *gob.Decoder) (any, error) {
+			d := new(T)
+			return d, dec.Decode(d)
+		},
+		upgrade: func(d any) any {
+			return upgrade(d.(*T))
+		},
+		downgrade: func(d any) (any, error) {
+			return downgrade(d.(*N))
+		},
+	}
+}
+
+// gobSteps holds the step from every version of the gob format before the
+// current one to the next, by version.
+var gobSteps = map[byte]gobStep{
+	1: newGobStep((*gobDbV1).upgrade, downgradeV1),
+	2: newGobStep((*gobDbV2).upgrade, downgradeV2),
+	3: newGobStep((*gobDbV3).upgrade, downgradeV3),
+	4: newGobStep((*gobDbV4).upgrade, downgradeV4),
+	5: newGobStep((*gobDbV5).upgrade, downgradeV5),
+	6: newGobStep((*gobDbV6).upgrade, downgradeV6),
+	7: newGobStep((*gobDbV7).upgrade, downgradeV7),
+	8: newGobStep((*gobDbV8).upgrade, downgradeV8),
+}
+
+// encodeGob writes d to enc as the given version of the gob format.
+func encodeGob(enc *gob.Encoder, d *gobDb, version byte) error {
+	var v any = d
+	for n := gobDbGobVersion - 1; n >= version; n-- {
+		var err error
+		if v, err = gobSteps[n].downgrade(v); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(v)
+}
+
+// decodeGob reads the given version of the gob format from dec, upgrading it
+// to the current version.
+func decodeGob(dec *gob.Decoder, version byte) (*gobDb, error) {
+	if version == gobDbGobVersion {
+		var d gobDb
+		if err := dec.Decode(&d); err != nil {
+			return nil, err
+		}
+		return &d, nil
+	}
+
+	v, err := gobSteps[version].decode(dec)
+	if err != nil {
+		return nil, err
+	}
+	for n := version; n < gobDbGobVersion; n++ {
+		v = gobSteps[n].upgrade(v)
+	}
+	return v.(*gobDb), nil
+}
+
+// ErrGobVersion is returned by GobEncodeVersion for a version of the gob
+// format that doesn't exist.
+var ErrGobVersion = errors.New("goaround: unsupported gob format version")
 
 // GobEncode implements the gob.GobEncoder interface.
 func (db *Db) GobEncode() ([]byte, error) {
+	return db.GobEncodeVersion(int(gobDbGobVersion))
+}
+
+// GobEncodeVersion is like GobEncode, but writes the given version of the
+// format, so that older code can read the result during a rolling upgrade.
+// Versions 1 to 9 are supported, version 9 being the one GobEncode writes.
+// Only versions 6 and later can be compressed (see WithCompression); the
+// older versions are written uncompressed. An older version can only be
+// written for a database it can hold: versions before 9 need one not created
+// by NewCalendar, versions before 8 one with no location or offset, versions
+// before 7, which give the resolution in whole seconds, one with no finer
+// resolution, versions before 5 one with no xfiles factor, versions before 4
+// one with no heartbeat, versions before 3 a Gauge with no unknown time, and
+// version 1 one consolidated by Average alone.
+func (db *Db) GobEncodeVersion(version int) ([]byte, error) {
+	if version < 1 || version > int(gobDbGobVersion) {
+		return nil, ErrGobVersion
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.gobEncode(version)
+}
+
+// gobEncode implements GobEncodeVersion for a supported version, with the
+// database already locked.
+func (db *Db) gobEncode(version int) ([]byte, error) {
+	d := gobDb{db.res, db.entries, nil, db.head, db.tail, db.currentStart,
+		db.currentStop, db.lastEntry, db.cfs, db.kind, db.lastRaw,
+		db.lastCount, db.unknownTime, db.heartbeat, db.xff, db.offset, "", db.unit}
+	if db.loc != nil {
+		d.Location = db.loc.String()
+	}
+	if db.compress && version >= 6 {
+		d.Entries, d.Packed = nil, packEntries(db.entries, len(db.cfs))
+	}
+
 	var buf bytes.Buffer
-	d := gobDb{db.res, db.entries, db.head, db.tail, db.currentStart,
-		db.currentStop, db.lastEntry}
 	enc := gob.NewEncoder(&buf)
 
-	err := enc.Encode(gobDbGobVersion)
+	err := enc.Encode(byte(version))
 	if err != nil {
 		return nil, err
 	}
 
-	err = enc.Encode(d)
+	err = encodeGob(enc, &d, byte(version))
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +482,11 @@ func (db *Db) GobEncode() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// GobDecode implements the gob.GobDecoder interface.
+// GobDecode implements the gob.GobDecoder interface. It reads every version of
+// the format GobEncodeVersion can write. Data describing a database that
+// couldn't exist is rejected with ErrBadFile (test with errors.Is), and a
+// database kept in a file (see Open) can't be replaced, so GobDecode returns
+// ErrKeptInFile for one.
 func (db *Db) GobDecode(b []byte) error {
 	if len(b) == 0 {
 		return errors.New("rrdb.GobDecode: no data")
@@ -98,23 +501,212 @@ func (db *Db) GobDecode(b []byte) error {
 	if err != nil {
 		return err
 	}
-	if version != gobDbGobVersion {
+	if version < 1 || version > gobDbGobVersion {
 		return errors.New("rrdb.GobDecode: unknown version")
 	}
 
-	var d gobDb
-	err = dec.Decode(&d)
+	d, err := decodeGob(dec, version)
+	if err != nil {
+		return err
+	}
+	entries, err := unpackGob(d.Entries, d.Packed, d.Cfs)
 	if err != nil {
 		return err
 	}
 
+	// Check everything the database relies on, so that damaged or crafted
+	// data is rejected here rather than panicking later
+	capacity := 0
+	if len(d.Cfs) > 0 {
+		capacity = len(entries) / len(d.Cfs)
+	}
+	if checkConsolidations(d.Cfs) != nil || capacity == 0 || len(entries) != capacity*len(d.Cfs) ||
+		d.Kind < 0 || int(d.Kind) >= len(dataSourceNames) ||
+		(d.Calendar == 0 && d.Res <= 0) || (d.Calendar != 0 && (!d.Calendar.valid() || d.Res != 0)) ||
+		(d.Res > 0 && (d.Offset < 0 || d.Offset >= d.Res)) ||
+		d.Head < -1 || d.Head >= capacity || d.Tail < -1 || d.Tail >= capacity ||
+		(d.Head == -1) != (d.Tail == -1) ||
+		(d.Tail != -1 && !d.CurrentStop.After(d.CurrentStart)) ||
+		d.Heartbeat < 0 || !(d.XFF >= 0 && d.XFF <= 1) {
+		return ErrBadFile
+	}
+	var loc *time.Location
+	if d.Location != "" {
+		if loc, err = time.LoadLocation(d.Location); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file != nil {
+		return ErrKeptInFile
+	}
+
 	db.res = d.Res
-	db.entries = d.Entries
+	db.cfs = d.Cfs
+	db.entries = entries
 	db.head = d.Head
 	db.tail = d.Tail
 	db.currentStart = d.CurrentStart
 	db.currentStop = d.CurrentStop
 	db.lastEntry = d.LastEntry
+	db.kind = d.Kind
+	db.lastRaw = d.LastRaw
+	db.lastCount = d.LastCount
+	db.unknownTime = d.UnknownTime
+	db.heartbeat = d.Heartbeat
+	db.xff = d.XFF
+	db.offset = d.Offset
+	db.loc = loc
+	db.unit = d.Calendar
+	db.compress = d.Packed != nil
+	db.updates++
+
+	return nil
+}
+
+/*****************************************************************************/
+// What follows is support for saving a Db to a file and loading it back. The
+// file holds the gob encoding of the Db, preceded by a small header:
+//
+//	magic    [8]byte  "goarsave"
+//	checksum uint32   CRC-32 (Castagnoli) of the gob encoding
+//	length   uint64   length of the gob encoding
+//
+// all little-endian. Files are written to a temporary file, synced, and then
+// renamed over the destination, so a crash part way through saving leaves
+// the previous file intact.
+/*****************************************************************************/
+
+var savedMagic = [8]byte{'g', 'o', 'a', 'r', 's', 'a', 'v', 'e'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksum is returned by LoadFile when the file's contents don't match its
+// checksum, meaning the file has been corrupted.
+var ErrChecksum = errors.New("goaround: checksum mismatch, file is corrupt")
+
+type savedHeader struct {
+	Magic    [8]byte
+	Checksum uint32
+	Length   uint64
+}
+
+// SaveFile saves the database to the file at path, atomically replacing any
+// file already there.
+func (db *Db) SaveFile(path string) error {
+	b, err := db.GobEncode()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, wrapSaved(b))
+}
+
+// LoadFile replaces the contents of the database with those saved in the
+// file at path by SaveFile. If the file is damaged, LoadFile returns
+// ErrChecksum or ErrBadFile (test with errors.Is) and the database is not
+// changed. Like GobDecode, it returns ErrKeptInFile for a database kept in a
+// file.
+func (db *Db) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := unwrapSaved(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// The checksum matched, so whatever fails to decode was saved that way
+	err = db.GobDecode(b)
+	switch {
+	case err == nil, errors.Is(err, ErrKeptInFile):
+		return err
+	case errors.Is(err, ErrBadFile):
+		return fmt.Errorf("%s: %w", path, err)
+	default:
+		return fmt.Errorf("%s: %w (%v)", path, ErrBadFile, err)
+	}
+}
+
+// wrapSaved returns b preceded by a header, ready to save to a file.
+func wrapSaved(b []byte) []byte {
+	var buf bytes.Buffer
+	h := savedHeader{savedMagic, crc32.Checksum(b, crcTable), uint64(len(b))}
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(b)
+	return buf.Bytes()
+}
+
+// unwrapSaved checks the header written by wrapSaved and returns what
+// follows it.
+func unwrapSaved(data []byte) ([]byte, error) {
+	var h savedHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return nil, ErrBadFile
+	}
+	if h.Magic != savedMagic {
+		return nil, ErrBadFile
+	}
+
+	b := data[binary.Size(h):]
+	if uint64(len(b)) != h.Length {
+		return nil, ErrBadFile
+	}
+	if crc32.Checksum(b, crcTable) != h.Checksum {
+		return nil, ErrChecksum
+	}
+	return b, nil
+}
+
+// writeFileAtomic writes data to the file at path by way of a temporary file
+// in the same directory, so that path holds either its old contents or all
+// of data, even if the system crashes.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
 
+	err = writeSynced(f, data)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make the rename itself durable
+	syncDir(dir)
 	return nil
 }
+
+// writeSynced writes data to f, commits it to stable storage, and closes f.
+func writeSynced(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir commits the entries of directory dir to stable storage. Not every
+// system can sync a directory, so failing to is not treated as an error.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
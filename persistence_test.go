@@ -34,20 +34,24 @@ package goaround
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 // TestEmptyRoundtrip tests with an empty new database.
 func TestEmptyRoundtrip(t *testing.T) {
-	db := New(8, 17)
+	db := New(8*time.Second, 17)
 	doRoundtrip(db, t)
 }
 
 // TestDataRoundtrip tests with a new database with all elements filled with
 // (fake) data.
 func TestDataRoundtrip(t *testing.T) {
-	db := New(30, 5)
+	db := New(30*time.Second, 5)
 	baseTime := time.Now()
 	db.head = 1
 	db.tail = 3
@@ -57,9 +61,191 @@ func TestDataRoundtrip(t *testing.T) {
 	for i, _ := range db.entries {
 		db.entries[i] = float32(i * 7.0)
 	}
+	db.entries[2] = unknown
 	doRoundtrip(db, t)
 }
 
+// TestConsolidationRoundtrip tests with a database keeping several
+// consolidation functions.
+func TestConsolidationRoundtrip(t *testing.T) {
+	db := New(60*time.Second, 3, WithConsolidation(Max, Average, Count), WithXFF(0.25))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:01Z")
+	for i := 0; i < 10; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*25)*time.Second))
+	}
+	doRoundtrip(db, t)
+}
+
+// TestCounterRoundtrip tests with a counter database, which has a heartbeat,
+// part way through a timebox.
+func TestCounterRoundtrip(t *testing.T) {
+	db := New(60*time.Second, 3, WithDataSource(Counter), WithHeartbeat(2*time.Minute))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:10:01Z")
+	db.AddCounterAt(1<<40, base)
+	db.AddCounterAt(1<<40+500, base.Add(10*time.Second))
+	doRoundtrip(db, t)
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden file for the current gob version")
+
+// TestGobVersions decodes a golden file written by each version of the gob
+// format, and checks that each version can still be written and read back.
+func TestGobVersions(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	gaugeSamples := func(db *Db) *Db {
+		for i := 0; i < 10; i++ {
+			db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+		}
+		// The first versions didn't keep the last reading
+		db.lastRaw, db.lastCount = 0, 0
+		return db
+	}
+	counterSamples := func(db *Db) *Db {
+		for i := 0; i < 10; i++ {
+			db.AddCounterAt(uint64(1000+i*i*20), base.Add(time.Duration(i*20)*time.Second))
+		}
+		db.AddCounterAt(5000, base.Add(400*time.Second))
+		return db
+	}
+
+	// Each golden file holds a database using every option its version
+	// could hold, starting from a gauge written before there were any
+	cfs := WithConsolidation(Average, Max, Last)
+	counter := counterSamples(New(30*time.Second, 5, cfs, WithDataSource(Counter),
+		WithHeartbeat(time.Minute), WithXFF(0.5)))
+	compressed := counter.Snapshot()
+	compressed.compress = true
+	tests := []struct {
+		file    string
+		version int
+		want    *Db
+	}{
+		{"v1.gob", 1, gaugeSamples(New(30*time.Second, 5))},
+		{"v2.gob", 2, gaugeSamples(New(30*time.Second, 5, cfs))},
+		{"v3.gob", 3, counterSamples(New(30*time.Second, 5, cfs, WithDataSource(Counter)))},
+		{"v4.gob", 4, counterSamples(New(30*time.Second, 5, cfs, WithDataSource(Counter),
+			WithHeartbeat(time.Minute)))},
+		{"v5.gob", 5, counter},
+		{"v6.gob", 6, counter},
+		{"v6-compressed.gob", 6, compressed},
+		{"v7.gob", 7, counter},
+		{"v7-compressed.gob", 7, compressed},
+		{"v8.gob", 8, counter},
+		{"v8-compressed.gob", 8, compressed},
+		{"v9.gob", 9, counter},
+		{"v9-compressed.gob", 9, compressed},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join("testdata", test.file)
+		if *updateGolden && test.version == int(gobDbGobVersion) {
+			b, _ := test.want.GobEncode()
+			os.WriteFile(path, b, 0666)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Reading golden file: %v", err)
+		}
+		db := new(Db)
+		if err := db.GobDecode(b); err != nil {
+			t.Errorf("%s: GobDecode returned %v", test.file, err)
+		} else if !db.equals(test.want) {
+			t.Errorf("%s: decoded db does not match", test.file)
+		}
+
+		b, err = test.want.GobEncodeVersion(test.version)
+		if err != nil {
+			t.Errorf("%s: GobEncodeVersion(%d) returned %v", test.file, test.version, err)
+			continue
+		}
+		db = new(Db)
+		if err := db.GobDecode(b); err != nil {
+			t.Errorf("%s: GobDecode of version %d returned %v", test.file, test.version, err)
+		} else if !db.equals(test.want) {
+			t.Errorf("%s: db does not match after writing version %d", test.file, test.version)
+		}
+	}
+
+	// Versions that can't hold everything in a database refuse to write it,
+	// rather than leave older code to misread it
+	for version := 1; version < 5; version++ {
+		if _, err := counter.GobEncodeVersion(version); err == nil {
+			t.Errorf("GobEncodeVersion(%d) of counter db succeeded", version)
+		}
+	}
+
+	// Only the current version can hold a resolution finer than a second
+	fine := New(250*time.Millisecond, 5)
+	fine.AddAt(1, base)
+	fine.AddAt(2, base.Add(300*time.Millisecond))
+	doRoundtrip(fine, t)
+	if _, err := fine.GobEncodeVersion(6); err == nil {
+		t.Errorf("GobEncodeVersion(6) of sub-second db succeeded")
+	}
+
+	for _, version := range []int{0, int(gobDbGobVersion) + 1, 257} {
+		if _, err := counter.GobEncodeVersion(version); !errors.Is(err, ErrGobVersion) {
+			t.Errorf("GobEncodeVersion(%d) returned %v, expected ErrGobVersion", version, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(gobDbGobVersion + 1)
+	if err := new(Db).GobDecode(buf.Bytes()); err == nil {
+		t.Errorf("GobDecode of a future version succeeded")
+	}
+}
+
+// TestGobDecodeBad checks that GobDecode rejects data describing a database
+// that couldn't exist, rather than leaving it to panic later.
+func TestGobDecodeBad(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	good := func() gobDb {
+		return gobDb{Res: 30 * time.Second, Entries: make([]float32, 4), Head: 0, Tail: 1,
+			CurrentStart: base, CurrentStop: base.Add(30 * time.Second), LastEntry: base,
+			Cfs: []Consolidation{Average}, Kind: Gauge, XFF: 1}
+	}
+	encode := func(d gobDb) []byte {
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		enc.Encode(gobDbGobVersion)
+		enc.Encode(d)
+		return buf.Bytes()
+	}
+	if err := new(Db).GobDecode(encode(good())); err != nil {
+		t.Fatalf("GobDecode of a good db returned %v", err)
+	}
+
+	for i, bad := range []func(d *gobDb){
+		func(d *gobDb) { d.Tail, d.Kind = 9, 9 },
+		func(d *gobDb) { d.Tail = 4 },
+		func(d *gobDb) { d.Head = -2 },
+		func(d *gobDb) { d.Head = -1 },
+		func(d *gobDb) { d.Kind = 9 },
+		func(d *gobDb) { d.Cfs = nil },
+		func(d *gobDb) { d.Cfs = []Consolidation{Average, Average} },
+		func(d *gobDb) { d.Cfs = []Consolidation{42} },
+		func(d *gobDb) { d.Cfs = []Consolidation{Average, Max, Min} },
+		func(d *gobDb) { d.Entries = nil },
+		func(d *gobDb) { d.Res = 0 },
+		func(d *gobDb) { d.Res = -time.Second },
+		func(d *gobDb) { d.Calendar = 9 },
+		func(d *gobDb) { d.Calendar = Month },
+		func(d *gobDb) { d.Offset = time.Minute },
+		func(d *gobDb) { d.CurrentStop = d.CurrentStart },
+		func(d *gobDb) { d.Heartbeat = -time.Second },
+		func(d *gobDb) { d.XFF = 2 },
+	} {
+		d := good()
+		bad(&d)
+		db := new(Db)
+		if err := db.GobDecode(encode(d)); !errors.Is(err, ErrBadFile) {
+			t.Errorf("Test %d: GobDecode returned %v, expected ErrBadFile", i, err)
+		}
+	}
+}
+
 // doRoundtrip will encode db to a gob, then decode it and make sure the data
 // is the same, reporting errors to t.
 func doRoundtrip(db *Db, t *testing.T) {
@@ -86,20 +272,87 @@ func doRoundtrip(db *Db, t *testing.T) {
 // equals will tell you if the Dbs a and b hold equal data.
 func (a *Db) equals(b *Db) bool {
 	simpleValues := a.res == b.res &&
+		a.offset == b.offset &&
+		a.loc.String() == b.loc.String() &&
+		a.unit == b.unit &&
 		a.head == b.head &&
 		a.tail == b.tail &&
-		a.currentStart == b.currentStart &&
-		a.currentStop == b.currentStop &&
-		a.lastEntry == b.lastEntry
+		a.currentStart.Equal(b.currentStart) &&
+		a.currentStop.Equal(b.currentStop) &&
+		a.lastEntry.Equal(b.lastEntry) &&
+		a.kind == b.kind &&
+		a.lastRaw == b.lastRaw &&
+		a.lastCount == b.lastCount &&
+		a.unknownTime == b.unknownTime &&
+		a.heartbeat == b.heartbeat &&
+		a.xff == b.xff &&
+		a.compress == b.compress
 
-	var entriesEqual bool = true
+	var cfsEqual bool = len(a.cfs) == len(b.cfs)
+	for i := 0; cfsEqual && i < len(a.cfs); i++ {
+		cfsEqual = a.cfs[i] == b.cfs[i]
+	}
+
+	var entriesEqual bool = len(a.entries) == len(b.entries)
 
 	for i, v := range a.entries {
-		if b.entries[i] != v {
+		if !sameValue(b.entries[i], v) {
 			entriesEqual = false
 			break
 		}
 	}
 
-	return simpleValues && entriesEqual
+	return simpleValues && cfsEqual && entriesEqual
+}
+
+func TestSaveLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.gar")
+	db := New(30*time.Second, 5, WithConsolidation(Average, Max))
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i < 10; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+
+	if err := db.SaveFile(path); err != nil {
+		t.Fatalf("db.SaveFile returned %v", err)
+	}
+	// Saving again replaces the file, and leaves no temporary files behind
+	db.AddAt(42, base.Add(time.Hour))
+	if err := db.SaveFile(path); err != nil {
+		t.Fatalf("db.SaveFile returned %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("directory holds %d files after saving, expected 1", len(files))
+	}
+
+	loaded := new(Db)
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatalf("loaded.LoadFile returned %v", err)
+	}
+	if !loaded.equals(db) {
+		t.Errorf("Saved and loaded db do not match")
+	}
+
+	// Flip a bit in the middle of the data
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0x10
+	os.WriteFile(path, data, 0666)
+	if err := loaded.LoadFile(path); !errors.Is(err, ErrChecksum) {
+		t.Errorf("loading corrupt file returned %v, expected ErrChecksum", err)
+	}
+
+	// Cut the file short
+	os.WriteFile(path, data[:len(data)-10], 0666)
+	if err := loaded.LoadFile(path); !errors.Is(err, ErrBadFile) {
+		t.Errorf("loading truncated file returned %v, expected ErrBadFile", err)
+	}
+
+	// Saved intact, but not a database
+	os.WriteFile(path, wrapSaved([]byte("not a gob")), 0666)
+	if err := loaded.LoadFile(path); !errors.Is(err, ErrBadFile) {
+		t.Errorf("loading undecodable file returned %v, expected ErrBadFile", err)
+	}
+	if !loaded.equals(db) {
+		t.Errorf("failed loads changed the database")
+	}
 }
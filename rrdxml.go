@@ -0,0 +1,386 @@
+/*
+ * File:	rrdxml.go
+ *
+ * Implements importing and exporting the XML format of rrdtool dump.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*****************************************************************************/
+// What follows is support for the XML written by "rrdtool dump" and read by
+// "rrdtool restore", to help with moving from rrdtool to goaround.
+//
+// An rrd file holds one or more data sources (DSs), all updated together,
+// and one or more round-robin archives (RRAs), each keeping one
+// consolidation function of every data source over rows of pdp_per_row
+// steps. Each row of an RRA is stamped with the time its interval ends,
+// and the last row ends at the last multiple of its interval at or before
+// the last update. The data since then that has yet to make it into a row
+// is kept separately, as the DS's partly built primary data point (PDP).
+/*****************************************************************************/
+
+type rrdXML struct {
+	XMLName    xml.Name `xml:"rrd"`
+	Step       int      `xml:"step"`
+	LastUpdate int64    `xml:"lastupdate"`
+	DSs        []rrdDS  `xml:"ds"`
+	RRAs       []rrdRRA `xml:"rra"`
+}
+
+type rrdDS struct {
+	Name       string `xml:"name"`
+	Type       string `xml:"type"`
+	Heartbeat  int    `xml:"minimal_heartbeat"`
+	LastDS     string `xml:"last_ds"`
+	Value      string `xml:"value"` // of the PDP so far, rate times seconds
+	UnknownSec int    `xml:"unknown_sec"`
+}
+
+type rrdRRA struct {
+	CF        string   `xml:"cf"`
+	PdpPerRow int      `xml:"pdp_per_row"`
+	XFF       string   `xml:"params>xff"`
+	Rows      []rrdRow `xml:"database>row"`
+}
+
+type rrdRow struct {
+	V []string `xml:"v"` // one value for each DS
+}
+
+// ReadRRDXML reads the output of "rrdtool dump" from r, returning a Multi for
+// each data source, keyed by its name. The RRAs with the same number of steps
+// per row become one archive of the Multi, whose capacity is that of the
+// largest of them. Every archive keeps the consolidation function of every
+// RRA; where an archive has no RRA for a function, its values for that
+// function are unknown. RRAs of consolidation functions other than AVERAGE,
+// MIN, MAX and LAST (such as rrdtool's forecasting functions) are ignored.
+//
+// The data sources' heartbeat and type, and the RRAs' xfiles factor, are
+// kept. The last reading of each data source and any data not yet
+// consolidated into rows are also carried over, as far as they can be, so
+// that new samples carry on from where rrdtool left off.
+func ReadRRDXML(r io.Reader) (map[string]*Multi, error) {
+	var x rrdXML
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, err
+	}
+	if x.Step <= 0 {
+		return nil, errors.New("goaround: rrdtool dump has no step")
+	}
+
+	// Group the RRAs by steps per row, and find every function kept
+	groups := make(map[int][]rrdRRA)
+	var cfs []Consolidation
+	for _, rra := range x.RRAs {
+		var cf Consolidation
+		if cf.UnmarshalText([]byte(strings.TrimSpace(rra.CF))) != nil || cf == Sum || cf == Count {
+			continue
+		}
+		if rra.PdpPerRow <= 0 || len(rra.Rows) == 0 {
+			return nil, errors.New("goaround: rrdtool dump has an empty RRA")
+		}
+		groups[rra.PdpPerRow] = append(groups[rra.PdpPerRow], rra)
+		if checkConsolidations(append(cfs, cf)) == nil {
+			cfs = append(cfs, cf)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("goaround: rrdtool dump has no usable RRAs")
+	}
+	var pdps []int
+	for pdp := range groups {
+		pdps = append(pdps, pdp)
+	}
+	sort.Ints(pdps)
+	for _, pdp := range pdps {
+		if pdp%pdps[0] != 0 {
+			return nil, fmt.Errorf("goaround: rrdtool dump has RRAs of %d steps, not a multiple of %d",
+				pdp, pdps[0])
+		}
+	}
+
+	multis := make(map[string]*Multi)
+	for i, ds := range x.DSs {
+		name := strings.TrimSpace(ds.Name)
+		var kind DataSource
+		if err := kind.UnmarshalText([]byte(strings.TrimSpace(ds.Type))); err != nil {
+			return nil, fmt.Errorf("goaround: data source %s: %w", name, err)
+		}
+		opts := []Option{WithConsolidation(cfs...), WithDataSource(kind)}
+		if ds.Heartbeat > 0 {
+			opts = append(opts, WithHeartbeat(time.Duration(ds.Heartbeat)*time.Second))
+		}
+
+		m := new(Multi)
+		for _, pdp := range pdps {
+			db, err := readRRDArchive(&x, i, groups[pdp], pdp, cfs, opts)
+			if err != nil {
+				return nil, fmt.Errorf("goaround: data source %s: %w", name, err)
+			}
+			m.archives = append(m.archives, db)
+		}
+
+		// The finest archive holds the data since the last row of each
+		// coarser one, which rrdtool keeps partly consolidated. Roll it
+		// up, except for the last timebox, which the Multi will roll up
+		// when it moves on from it.
+		fine := m.archives[0]
+		for _, db := range m.archives[1:] {
+			start := fine.oldest()
+			for j := 0; j < fine.length()-1; j++ {
+				stop := fine.step(start, 1)
+				if !start.Before(db.currentStop) || db.tail == -1 {
+					db.rollUp(start, stop, fine.box(fine.slot(j)))
+				}
+				start = stop
+			}
+		}
+
+		if v, err := strconv.ParseFloat(strings.TrimSpace(ds.LastDS), 64); err == nil {
+			fine.lastRaw, fine.lastCount = v, uint64(math.Max(0, v))
+			if count, err := strconv.ParseUint(strings.TrimSpace(ds.LastDS), 10, 64); err == nil {
+				fine.lastCount = count
+			}
+		}
+		multis[name] = m
+	}
+	return multis, nil
+}
+
+// readRRDArchive builds a database, created with opts, from the rows for the
+// i'th data source of the RRAs rras, which keep pdp steps per row. For RRAs of
+// one step per row, the data source's partly built PDP becomes the database's
+// last timebox.
+func readRRDArchive(x *rrdXML, i int, rras []rrdRRA, pdp int, cfs []Consolidation, opts []Option) (*Db, error) {
+	n := 0
+	for _, rra := range rras {
+		if len(rra.Rows) > n {
+			n = len(rra.Rows)
+		}
+	}
+	if xff, err := strconv.ParseFloat(strings.TrimSpace(rras[0].XFF), 64); err == nil && xff >= 0 && xff <= 1 {
+		opts = append(opts, WithXFF(xff))
+	}
+	db := New(time.Duration(x.Step*pdp)*time.Second, n, opts...)
+
+	// Each row ends at the start of the next, the last one at the last
+	// multiple of the row's length at or before the last update
+	res := int64(x.Step * pdp)
+	end := time.Unix(x.LastUpdate-(x.LastUpdate%res+res)%res, 0)
+	first := end.Add(-time.Duration(res*int64(n)) * time.Second)
+
+	var boxes []boxValues
+	for row := 0; row < n; row++ {
+		b := boxValues{first.Add(time.Duration(res*int64(row)) * time.Second), make([]float32, len(cfs))}
+		known := false
+		for k := range b.v {
+			b.v[k] = unknown
+		}
+		for _, rra := range rras {
+			j := row - (n - len(rra.Rows))
+			if j < 0 {
+				continue
+			}
+			if i >= len(rra.Rows[j].V) {
+				return nil, errors.New("row has too few values")
+			}
+			var cf Consolidation
+			cf.UnmarshalText([]byte(strings.TrimSpace(rra.CF)))
+			v, err := strconv.ParseFloat(strings.TrimSpace(rra.Rows[j].V[i]), 64)
+			if err != nil {
+				return nil, err
+			}
+			b.v[db.cfIndex(cf)] = float32(v)
+			known = known || !math.IsNaN(v)
+		}
+
+		// Rows before any data was recorded are left out
+		if known || len(boxes) > 0 {
+			boxes = append(boxes, b)
+		}
+	}
+
+	// The PDP covers the time from the end of the last row to the last
+	// update, less the part of that which is unknown
+	ds := x.DSs[i]
+	last := time.Unix(x.LastUpdate, 0)
+	unknownTime := time.Duration(ds.UnknownSec) * time.Second
+	known := last.Sub(end) - unknownTime
+	value, err := strconv.ParseFloat(strings.TrimSpace(ds.Value), 64)
+	if pdp == 1 && err == nil && !math.IsNaN(value) && known > 0 {
+		b := boxValues{end, make([]float32, len(cfs))}
+		for k := range b.v {
+			b.v[k] = float32(value / known.Seconds())
+		}
+		boxes = append(boxes, b)
+	} else {
+		last, unknownTime = time.Time{}, 0
+	}
+
+	if err := db.fill(boxes, last); err != nil {
+		return nil, err
+	}
+	db.unknownTime = unknownTime
+	return db, nil
+}
+
+// WriteRRDXML writes the database to w in the XML format of "rrdtool dump",
+// as a single data source named name, with an RRA of one step per row for
+// each of the database's consolidation functions that rrdtool has (so not
+// Sum or Count). The result can be loaded into rrdtool with "rrdtool
+// restore".
+//
+// rrdtool keeps the data since the end of the last row as a partly built
+// primary data point, of a single value for all consolidation functions, so
+// the database's last timebox is written as its Average value, or its first
+// value if it doesn't keep Average. rrdtool also requires a heartbeat, so a
+// database without one is given a heartbeat of two timeboxes. rrdtool only
+// counts time in whole seconds from the epoch, so the database's resolution
+// must be a whole number of seconds, and its timeboxes aligned to the epoch in
+// UTC (see WithLocation and WithOffset).
+func (db *Db) WriteRRDXML(w io.Writer, name string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.res%time.Second != 0 {
+		return errors.New("goaround: rrdtool needs a resolution of whole seconds")
+	}
+	if !db.fixed() || db.offset != 0 {
+		return errors.New("goaround: rrdtool needs timeboxes aligned to the epoch in UTC")
+	}
+	step := int(db.res / time.Second)
+
+	var cfs []int
+	for k, cf := range db.cfs {
+		if cf != Sum && cf != Count {
+			cfs = append(cfs, k)
+		}
+	}
+	if len(cfs) == 0 {
+		return errors.New("goaround: database has no consolidation functions rrdtool can represent")
+	}
+
+	heartbeat := int(db.heartbeat / time.Second)
+	if heartbeat == 0 {
+		heartbeat = 2 * step
+	}
+
+	// The data since the start of the last timebox is the PDP
+	var lastUpdate int64
+	lastDS, value, unknownSec := "U", math.NaN(), 0.0
+	if db.tail != -1 {
+		lastUpdate = db.lastEntry.Unix()
+		lastDS = strconv.FormatFloat(db.lastRaw, 'g', -1, 64)
+		if db.kind == Counter {
+			lastDS = strconv.FormatUint(db.lastCount, 10)
+		}
+
+		v := db.box(db.tail)[0]
+		for k, cf := range db.cfs {
+			if cf == Average {
+				v = db.box(db.tail)[k]
+			}
+		}
+		known := db.known().Seconds()
+		unknownSec = db.lastEntry.Sub(db.currentStart).Seconds() - known
+		value = float64(v) * known
+		if IsUnknown(v) {
+			value, unknownSec = 0, unknownSec+known
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE rrd SYSTEM "http://oss.oetiker.ch/rrdtool/rrdtool.dtd">
+<!-- Round Robin Database Dump -->
+<rrd>
+	<version>0003</version>
+`)
+	fmt.Fprintf(&b, "\t<step>%d</step> <!-- Seconds -->\n", step)
+	fmt.Fprintf(&b, "\t<lastupdate>%d</lastupdate> <!-- %s -->\n\n", lastUpdate,
+		time.Unix(lastUpdate, 0).UTC().Format("2006-01-02 15:04:05 MST"))
+	b.WriteString("\t<ds>\n\t\t<name> ")
+	xml.EscapeText(&b, []byte(name))
+	fmt.Fprintf(&b, " </name>\n\t\t<type> %v </type>\n", db.kind)
+	fmt.Fprintf(&b, "\t\t<minimal_heartbeat>%d</minimal_heartbeat>\n", heartbeat)
+	b.WriteString("\t\t<min>NaN</min>\n\t\t<max>NaN</max>\n\n\t\t<!-- PDP Status -->\n")
+	fmt.Fprintf(&b, "\t\t<last_ds>%s</last_ds>\n", lastDS)
+	fmt.Fprintf(&b, "\t\t<value>%.10e</value>\n", value)
+	fmt.Fprintf(&b, "\t\t<unknown_sec> %d </unknown_sec>\n\t</ds>\n\n", int(unknownSec))
+	b.WriteString("\t<!-- Round Robin Archives -->\n")
+
+	// Rows end where the next one starts, the last one where the last
+	// timebox starts; rows before any data are unknown
+	res := db.res
+	capacity := db.capacity()
+	first := time.Unix(lastUpdate, 0).Add(-res * time.Duration(capacity))
+	if db.tail != -1 {
+		first = db.currentStart.Add(-res * time.Duration(capacity))
+	}
+	for _, k := range cfs {
+		fmt.Fprintf(&b, "\t<rra>\n\t\t<cf>%v</cf>\n", db.cfs[k])
+		fmt.Fprintf(&b, "\t\t<pdp_per_row>1</pdp_per_row> <!-- %d seconds -->\n\n", step)
+		fmt.Fprintf(&b, "\t\t<params>\n\t\t<xff>%.10e</xff>\n\t\t</params>\n", db.xff)
+		b.WriteString(`		<cdp_prep>
+			<ds>
+			<primary_value>NaN</primary_value>
+			<secondary_value>NaN</secondary_value>
+			<value>NaN</value>
+			<unknown_datapoints>0</unknown_datapoints>
+			</ds>
+		</cdp_prep>
+		<database>
+`)
+		for row := 0; row < capacity; row++ {
+			end := first.Add(res * time.Duration(row+1))
+			v := unknown
+			if i := db.length() - 1 - capacity + row; i >= 0 {
+				v = db.box(db.slot(i))[k]
+			}
+			fmt.Fprintf(&b, "\t\t\t<!-- %s / %d --> <row><v>%.10e</v></row>\n",
+				end.UTC().Format("2006-01-02 15:04:05 MST"), end.Unix(), v)
+		}
+		b.WriteString("\t\t</database>\n\t</rra>\n")
+	}
+	b.WriteString("</rrd>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,181 @@
+/*
+ * File:	rrdxml_test.go
+ *
+ * Implements tests for the rrdxml.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkPoints reports to t any difference between the values of points and
+// expected.
+func checkPoints(t *testing.T, what string, points []Point, expected []float32) {
+	if len(points) != len(expected) {
+		t.Errorf("%s has %d points, expected %d", what, len(points), len(expected))
+		return
+	}
+	for i, p := range points {
+		if !sameValue(p.Value, expected[i]) {
+			t.Errorf("%s point %d is %v, expected %v", what, i, p.Value, expected[i])
+		}
+	}
+}
+
+func TestReadRRDXML(t *testing.T) {
+	f, err := os.Open("testdata/rrdtool.xml")
+	if err != nil {
+		t.Fatalf("Opening fixture: %v", err)
+	}
+	defer f.Close()
+
+	multis, err := ReadRRDXML(f)
+	if err != nil {
+		t.Fatalf("ReadRRDXML returned %v", err)
+	}
+	if len(multis) != 2 || multis["temp"] == nil || multis["bytes"] == nil {
+		t.Fatalf("ReadRRDXML returned %v, expected temp and bytes", multis)
+	}
+
+	temp := multis["temp"].Archives()
+	if len(temp) != 2 || temp[0].Res() != 60*time.Second || temp[0].Capacity() != 5 ||
+		temp[1].Res() != 120*time.Second || temp[1].Capacity() != 3 {
+		t.Fatalf("temp has the wrong archives")
+	}
+	if cfs := temp[1].Consolidations(); len(cfs) != 2 || cfs[0] != Average || cfs[1] != Max {
+		t.Errorf("temp keeps %v, expected AVERAGE and MAX", cfs)
+	}
+	if temp[0].Heartbeat() != 2*time.Minute || temp[0].XFF() != 0.5 {
+		t.Errorf("temp has heartbeat %v and xff %v", temp[0].Heartbeat(), temp[0].XFF())
+	}
+	if multis["bytes"].Archives()[0].DataSource() != Counter {
+		t.Errorf("bytes is not a Counter")
+	}
+
+	start, _ := time.Parse(time.RFC3339, "2013-01-01T07:50:00Z")
+	end := start.Add(time.Hour)
+	checkPoints(t, "temp AVERAGE", temp[0].Fetch(start, end), []float32{1, 2, 3, 4, 4.2})
+	checkPoints(t, "temp MAX", temp[0].FetchCF(Max, start, end), []float32{1.5, 2.5, 3.5, 4.5, 4.2})
+	checkPoints(t, "temp coarse AVERAGE", temp[1].Fetch(start, end), []float32{0.75, 2.5, 4})
+	checkPoints(t, "temp coarse MAX", temp[1].FetchCF(Max, start, end), []float32{unknown, unknown, 4.5})
+	checkPoints(t, "bytes AVERAGE", multis["bytes"].Archives()[0].Fetch(start, end),
+		[]float32{unknown, 10, 20, 30, 40})
+
+	// New samples carry on from the data rrdtool hadn't finished with
+	next, _ := time.Parse(time.RFC3339, "2013-01-01T08:04:10Z")
+	multis["temp"].AddAt(5, next)
+	checkPoints(t, "temp after update", temp[0].Fetch(start, end), []float32{2, 3, 4, 4.6, 5})
+	checkPoints(t, "temp coarse after update", temp[1].Fetch(start, end), []float32{0.75, 2.5, 4.3})
+	if err := multis["bytes"].AddCounterAt(123456+50*40, next); err != nil {
+		t.Errorf("bytes.AddCounterAt returned %v", err)
+	}
+	checkPoints(t, "bytes after update", multis["bytes"].Archives()[0].Fetch(start, end),
+		[]float32{10, 20, 30, 45, 50})
+
+	for _, bad := range []string{
+		`<rrd><step>60</step></rrd>`,
+		`<rrd><step>60</step><ds><name>x</name><type>COMPUTE</type></ds>
+			<rra><cf>AVERAGE</cf><pdp_per_row>1</pdp_per_row>
+			<database><row><v>1</v></row></database></rra></rrd>`,
+		`<rrd><step>60</step><ds><name>x</name><type>GAUGE</type></ds>
+			<rra><cf>AVERAGE</cf><pdp_per_row>2</pdp_per_row>
+			<database><row><v>1</v></row></database></rra>
+			<rra><cf>AVERAGE</cf><pdp_per_row>3</pdp_per_row>
+			<database><row><v>1</v></row></database></rra></rrd>`,
+		`<rrd><step>60</step><ds><name>x</name><type>GAUGE</type></ds>
+			<rra><cf>AVERAGE</cf><pdp_per_row>1</pdp_per_row>
+			<database><row><v>one</v></row></database></rra></rrd>`,
+	} {
+		if _, err := ReadRRDXML(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadRRDXML accepted %s", bad)
+		}
+	}
+}
+
+func TestWriteRRDXML(t *testing.T) {
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(60*time.Second, 5, WithConsolidation(Average, Max, Count), WithXFF(0.5))
+	for _, s := range []int{0, 20, 40, 60, 80, 120, 150, 210, 230} {
+		db.AddAt(float32(s)/10, base.Add(time.Duration(s)*time.Second))
+	}
+
+	var buf bytes.Buffer
+	if err := db.WriteRRDXML(&buf, "temp"); err != nil {
+		t.Fatalf("db.WriteRRDXML returned %v", err)
+	}
+	for _, want := range []string{
+		"<step>60</step>",
+		"<lastupdate>1357027430</lastupdate> <!-- 2013-01-01 08:03:50 UTC -->",
+		"<name> temp </name>",
+		"<type> GAUGE </type>",
+		"<minimal_heartbeat>120</minimal_heartbeat>",
+		"<last_ds>23</last_ds>",
+		"<value>1.0899999619e+03</value>",
+		"<unknown_sec> 0 </unknown_sec>",
+		"<cf>MAX</cf>",
+		"<!-- 2013-01-01 08:01:00 UTC / 1357027260 --> <row><v>4.0000000000e+00</v></row>",
+		"<!-- 2013-01-01 07:59:00 UTC / 1357027140 --> <row><v>NaN</v></row>",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("XML does not contain %s:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "COUNT") {
+		t.Errorf("XML has an RRA for COUNT")
+	}
+
+	// Reading it back gives the same data, except that the last timebox
+	// has just the one value
+	multis, err := ReadRRDXML(&buf)
+	if err != nil {
+		t.Fatalf("ReadRRDXML returned %v", err)
+	}
+	loaded := multis["temp"].Archives()[0]
+	end := base.Add(time.Hour)
+	if !sameFetch(loaded.Fetch(base, end), db.Fetch(base, end)) {
+		t.Errorf("AVERAGE of db read back does not match")
+	}
+	points, want := loaded.FetchCF(Max, base, end), db.FetchCF(Max, base, end)
+	last := len(want) - 1
+	if !sameFetch(points[:last], want[:last]) || points[last].Value != db.Get(db.Len()-1) {
+		t.Errorf("MAX of db read back does not match")
+	}
+
+	if err := New(60*time.Second, 5, WithConsolidation(Sum)).WriteRRDXML(&buf, "x"); err == nil {
+		t.Errorf("db.WriteRRDXML accepted a database with only SUM")
+	}
+	if err := New(1500*time.Millisecond, 5).WriteRRDXML(&buf, "x"); err == nil {
+		t.Errorf("db.WriteRRDXML accepted a resolution of 1.5 seconds")
+	}
+}
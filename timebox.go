@@ -31,16 +31,205 @@
 
 package goaround
 
-import "time"
-
-// If all of time were divided into equal-sized seconds (of length chunk),
-// BoxTime() will tell you the start time (start) and stop time (stop) of
-// the chunk that any particular point in time (t) resides in.
-func BoxTime(t time.Time, chunk int) (start time.Time, stop time.Time) {
-	unix := t.Unix()
-	var rem int64 = unix % int64(chunk)
-	unix = unix - rem
-	start = time.Unix(unix, 0)
-	stop = time.Unix(unix+int64(chunk), 0)
+import (
+	"math"
+	"time"
+)
+
+// unixEpoch is the time BoxTime aligns chunks to.
+var unixEpoch = time.Unix(0, 0)
+
+// If all of time were divided into equal-sized chunks, counting from the Unix
+// epoch, BoxTime() will tell you the start time (start) and stop time (stop)
+// of the chunk that any particular point in time (t) resides in. Chunks may be
+// any positive length, down to a nanosecond. Times before the epoch are boxed
+// the same way as those after it: start is never after t, and stop is always
+// after it.
+func BoxTime(t time.Time, chunk time.Duration) (start time.Time, stop time.Time) {
+	if chunk <= 0 {
+		panic("Chunk must be positive.")
+	}
+
+	// Truncate divides time into chunks counting from the zero time rather
+	// than the epoch, so shift t by how far into its chunk the epoch falls.
+	// It rounds down on either side of the zero time, unlike the % operator,
+	// which rounds negative Unix times up into the following chunk.
+	offset := unixEpoch.Sub(unixEpoch.Truncate(chunk))
+	start = t.Add(-offset).Truncate(chunk).Add(offset)
+	stop = start.Add(chunk)
 	return
 }
+
+// BoxIndex returns the index of the chunk, as divided up by BoxTime, that t
+// resides in. The chunk starting at the epoch is 0, those after it count up
+// from there, and those before it count down from -1. Any t will do for chunks
+// of whole seconds; for other chunks, t must be within 292 years of the epoch.
+func BoxIndex(t time.Time, chunk time.Duration) int64 {
+	start, _ := BoxTime(t, chunk)
+	sec := start.Unix()
+
+	// Chunks of whole seconds start on a whole second, so count in seconds,
+	// which can't overflow. Anything finer is counted in nanoseconds.
+	if chunk%time.Second == 0 {
+		return floorDiv(sec, int64(chunk/time.Second))
+	}
+	if sec >= math.MaxInt64/int64(time.Second) || sec <= math.MinInt64/int64(time.Second) {
+		panic("Time too far from the epoch to index.")
+	}
+	return floorDiv(sec*int64(time.Second)+int64(start.Nanosecond()), int64(chunk))
+}
+
+// floorDiv returns a divided by b, rounded down. b must be positive.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b < 0 {
+		q--
+	}
+	return q
+}
+
+// Boxes returns the start time of each chunk, as divided up by BoxTime, that
+// overlaps the range from start (inclusive) to end (exclusive), in
+// chronological order. It returns nil if end isn't after start.
+func Boxes(start, end time.Time, chunk time.Duration) []time.Time {
+	if chunk <= 0 {
+		panic("Chunk must be positive.")
+	}
+	if !end.After(start) {
+		return nil
+	}
+
+	var boxes []time.Time
+	for t, _ := BoxTime(start, chunk); t.Before(end); t = t.Add(chunk) {
+		boxes = append(boxes, t)
+	}
+	return boxes
+}
+
+// boxing describes how a database divides time into timeboxes: chunks of res
+// counted from the epoch, or units of the calendar, shifted by offset, as read
+// on the wall clock of loc. Following a wall clock, timeboxes across a change
+// of the clock (for daylight saving time) are longer or shorter than usual,
+// and one whose time is skipped over by the change doesn't exist at all. A
+// zone transition starts a timebox if the wall clock is set to the start of a
+// chunk, or to a different chunk.
+type boxing struct {
+	res    time.Duration  // length of a timebox, on the wall clock; 0 for a calendar unit
+	unit   Calendar       // unit of the calendar each timebox covers, if any
+	offset time.Duration  // shift from the epoch, between 0 and res, or from the unit's start
+	loc    *time.Location // location of the wall clock; nil for UTC
+}
+
+// fixed reports whether every timebox is res long.
+func (b boxing) fixed() bool {
+	return b.loc == nil && b.unit == 0
+}
+
+// location returns the location of the wall clock.
+func (b boxing) location() *time.Location {
+	if b.loc == nil {
+		return time.UTC
+	}
+	return b.loc
+}
+
+// chunk returns the start and stop times of the chunk that wall, a time read
+// off the wall clock as though it were in UTC, falls in.
+func (b boxing) chunk(wall time.Time) (start time.Time, stop time.Time) {
+	if b.unit != 0 {
+		return b.unit.chunk(wall)
+	}
+	return BoxTime(wall, b.res)
+}
+
+// boxTime returns the start and stop times of the timebox t falls in, in UTC.
+func (b boxing) boxTime(t time.Time) (start time.Time, stop time.Time) {
+	if b.fixed() {
+		start, stop = BoxTime(t.Add(-b.offset), b.res)
+		return start.Add(b.offset).UTC(), stop.Add(b.offset).UTC()
+	}
+	return b.localStart(t).UTC(), b.localStop(t).UTC()
+}
+
+// wall returns the time on the wall clock of b.loc at t, less the offset, as
+// though it were a time in UTC.
+func (b boxing) wall(t time.Time) time.Time {
+	_, zone := t.In(b.location()).Zone()
+	return t.UTC().Add(time.Duration(zone)*time.Second - b.offset)
+}
+
+// wallBox returns the start and stop times of the timebox t would fall in if
+// the wall clock of b.loc always kept the offset from UTC it has at t.
+func (b boxing) wallBox(t time.Time) (start time.Time, stop time.Time) {
+	wall := b.wall(t)
+	start, stop = b.chunk(wall)
+	return t.Add(start.Sub(wall)), t.Add(stop.Sub(wall))
+}
+
+// localStart returns the start of the timebox t falls in, following the wall
+// clock of b.loc.
+func (b boxing) localStart(t time.Time) time.Time {
+	for {
+		start, _ := b.wallBox(t)
+		zoneStart, _ := t.In(b.location()).ZoneBounds()
+		if zoneStart.IsZero() || !start.Before(zoneStart) {
+			return start
+		}
+		if b.transition(zoneStart) {
+			return zoneStart
+		}
+		t = zoneStart.Add(-time.Nanosecond)
+	}
+}
+
+// localStop returns the end of the timebox t falls in, following the wall
+// clock of b.loc.
+func (b boxing) localStop(t time.Time) time.Time {
+	for {
+		_, stop := b.wallBox(t)
+		_, zoneEnd := t.In(b.location()).ZoneBounds()
+		if zoneEnd.IsZero() || stop.Before(zoneEnd) {
+			return stop
+		}
+		if b.transition(zoneEnd) {
+			return zoneEnd
+		}
+		t = zoneEnd
+	}
+}
+
+// transition reports whether the zone transition at time z starts a timebox.
+func (b boxing) transition(z time.Time) bool {
+	after := b.wall(z)
+	chunk, _ := b.chunk(after)
+	prev, _ := b.chunk(b.wall(z.Add(-time.Nanosecond)))
+	return chunk.Equal(after) || !chunk.Equal(prev)
+}
+
+// step returns the start of the timebox n timeboxes after the one that starts
+// at start, or before it if n is negative.
+func (b boxing) step(start time.Time, n int) time.Time {
+	if b.fixed() {
+		return start.Add(b.res * time.Duration(n))
+	}
+	for ; n > 0; n-- {
+		_, start = b.boxTime(start)
+	}
+	for ; n < 0; n++ {
+		start, _ = b.boxTime(start.Add(-time.Nanosecond))
+	}
+	return start
+}
+
+// count returns the number of timeboxes from the one that starts at from up
+// to the one t falls in, which must not be before from.
+func (b boxing) count(from, t time.Time) int {
+	if b.fixed() {
+		return int(t.Sub(from) / b.res)
+	}
+	n := 0
+	for _, stop := b.boxTime(from); !t.Before(stop); _, stop = b.boxTime(stop) {
+		n++
+	}
+	return n
+}
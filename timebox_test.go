@@ -37,17 +37,35 @@ import (
 
 var timeBoxTests = []struct {
 	in     string
-	chunk  int
+	chunk  time.Duration
 	start  string
 	stop   string
 	format string
 }{
-	{"2013-01-02T10:04:10Z", 30, "2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", time.RFC3339},
-	{"2013-01-02T10:04:29Z", 30, "2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", time.RFC3339},
-	{"2013-01-02T10:04:30Z", 30, "2013-01-02T10:04:30Z", "2013-01-02T10:05:00Z", time.RFC3339},
-	{"2013-01-02T10:04:10Z", 60, "2013-01-02T10:04:00Z", "2013-01-02T10:05:00Z", time.RFC3339},
-	{"2013-01-02T10:04:10Z", 3600 /* one hour */, "2013-01-02T10:00:00Z", "2013-01-02T11:00:00Z", time.RFC3339},
-	{"2013-01-02T10:04:10Z", 86400 /* one day */, "2013-01-02T00:00:00Z", "2013-01-03T00:00:00Z", time.RFC3339},
+	{"2013-01-02T10:04:10Z", 30 * time.Second, "2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", time.RFC3339},
+	{"2013-01-02T10:04:29Z", 30 * time.Second, "2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", time.RFC3339},
+	{"2013-01-02T10:04:30Z", 30 * time.Second, "2013-01-02T10:04:30Z", "2013-01-02T10:05:00Z", time.RFC3339},
+	{"2013-01-02T10:04:10Z", time.Minute, "2013-01-02T10:04:00Z", "2013-01-02T10:05:00Z", time.RFC3339},
+	{"2013-01-02T10:04:10Z", time.Hour, "2013-01-02T10:00:00Z", "2013-01-02T11:00:00Z", time.RFC3339},
+	{"2013-01-02T10:04:10Z", 24 * time.Hour, "2013-01-02T00:00:00Z", "2013-01-03T00:00:00Z", time.RFC3339},
+	{"2013-01-02T10:04:29.999Z", 30 * time.Second, "2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", time.RFC3339Nano},
+	{"2013-01-02T10:04:10.05Z", 100 * time.Millisecond, "2013-01-02T10:04:10Z", "2013-01-02T10:04:10.1Z", time.RFC3339Nano},
+	{"2013-01-02T10:04:10.8Z", 250 * time.Millisecond, "2013-01-02T10:04:10.75Z", "2013-01-02T10:04:11Z", time.RFC3339Nano},
+	{"2013-01-02T10:04:10.000000123Z", time.Nanosecond, "2013-01-02T10:04:10.000000123Z", "2013-01-02T10:04:10.000000124Z", time.RFC3339Nano},
+	{"2013-01-02T10:04:10Z", 7 * time.Second, "2013-01-02T10:04:05Z", "2013-01-02T10:04:12Z", time.RFC3339},
+	{"2013-01-02T10:04:10Z", 7 * 24 * time.Hour, "2012-12-27T00:00:00Z", "2013-01-03T00:00:00Z", time.RFC3339},
+	{"1969-12-31T23:59:50Z", 30 * time.Second, "1969-12-31T23:59:30Z", "1970-01-01T00:00:00Z", time.RFC3339},
+	{"1880-03-04T05:06:07Z", 24 * time.Hour, "1880-03-04T00:00:00Z", "1880-03-05T00:00:00Z", time.RFC3339},
+	{"1600-07-08T09:10:11.5Z", time.Hour, "1600-07-08T09:00:00Z", "1600-07-08T10:00:00Z", time.RFC3339Nano},
+	{"2400-07-08T09:10:11Z", 7 * time.Second, "2400-07-08T09:10:07Z", "2400-07-08T09:10:14Z", time.RFC3339},
+	// Times before the epoch are boxed into the chunk they fall in, not the
+	// one after it
+	{"1969-12-31T23:59:59Z", time.Minute, "1969-12-31T23:59:00Z", "1970-01-01T00:00:00Z", time.RFC3339},
+	{"1969-12-31T23:59:59.999Z", time.Second, "1969-12-31T23:59:59Z", "1970-01-01T00:00:00Z", time.RFC3339Nano},
+	{"1969-12-31T23:59:00Z", time.Minute, "1969-12-31T23:59:00Z", "1970-01-01T00:00:00Z", time.RFC3339},
+	{"1969-07-20T20:17:40Z", time.Hour, "1969-07-20T20:00:00Z", "1969-07-20T21:00:00Z", time.RFC3339},
+	{"1969-07-20T20:17:40Z", 24 * time.Hour, "1969-07-20T00:00:00Z", "1969-07-21T00:00:00Z", time.RFC3339},
+	{"1969-12-31T23:59:55Z", 7 * time.Second, "1969-12-31T23:59:53Z", "1970-01-01T00:00:00Z", time.RFC3339},
 }
 
 func TestTimeboxing(t *testing.T) {
@@ -64,3 +82,184 @@ func TestTimeboxing(t *testing.T) {
 		}
 	}
 }
+
+var boxIndexTests = []struct {
+	in    string
+	chunk time.Duration
+	index int64
+}{
+	{"1970-01-01T00:00:00Z", time.Minute, 0},
+	{"1970-01-01T00:00:59Z", time.Minute, 0},
+	{"1970-01-01T00:01:00Z", time.Minute, 1},
+	{"1969-12-31T23:59:59Z", time.Minute, -1},
+	{"1969-12-31T23:59:00Z", time.Minute, -1},
+	{"1969-12-31T23:58:59Z", time.Minute, -2},
+	{"1969-12-31T23:59:59.5Z", 250 * time.Millisecond, -2},
+	{"2013-01-02T10:04:10Z", time.Hour, 376978},
+	{"1880-03-15T06:00:00Z", 24 * time.Hour, -32798},
+	{"1600-01-01T12:34:56Z", time.Second, -11676050704},
+	{"1700-01-01T00:00:01Z", 1500 * time.Millisecond, -5680224000},
+	{"2200-01-01T00:00:00Z", 1500 * time.Millisecond, 4838745600},
+	{"0001-01-01T00:00:00Z", 24 * time.Hour, -719162},
+}
+
+func TestBoxIndex(t *testing.T) {
+	for i, tt := range boxIndexTests {
+		in, _ := time.Parse(time.RFC3339Nano, tt.in)
+		if index := BoxIndex(in, tt.chunk); index != tt.index {
+			t.Errorf("Test %d: BoxIndex(%v, %v) = %d, expected %d", i, in, tt.chunk, index, tt.index)
+		}
+	}
+}
+
+var boxesTests = []struct {
+	start string
+	end   string
+	chunk time.Duration
+	boxes []string
+}{
+	{"2013-01-02T10:04:10Z", "2013-01-02T10:05:00Z", 30 * time.Second,
+		[]string{"2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z"}},
+	{"2013-01-02T10:04:10Z", "2013-01-02T10:05:01Z", 30 * time.Second,
+		[]string{"2013-01-02T10:04:00Z", "2013-01-02T10:04:30Z", "2013-01-02T10:05:00Z"}},
+	{"2013-01-02T10:04:10Z", "2013-01-02T10:04:11Z", time.Hour,
+		[]string{"2013-01-02T10:00:00Z"}},
+	// Across the epoch
+	{"1969-12-31T23:59:30Z", "1970-01-01T00:00:30Z", 20 * time.Second,
+		[]string{"1969-12-31T23:59:20Z", "1969-12-31T23:59:40Z", "1970-01-01T00:00:00Z", "1970-01-01T00:00:20Z"}},
+	{"1969-12-31T23:00:00Z", "1969-12-31T23:00:00Z", time.Hour, nil},
+	{"1969-12-31T23:30:00Z", "1969-12-31T23:00:00Z", time.Hour, nil},
+}
+
+func TestBoxes(t *testing.T) {
+	for i, tt := range boxesTests {
+		start, _ := time.Parse(time.RFC3339, tt.start)
+		end, _ := time.Parse(time.RFC3339, tt.end)
+		boxes := Boxes(start, end, tt.chunk)
+		if len(boxes) != len(tt.boxes) {
+			t.Errorf("Test %d: got %v, expected %v", i, boxes, tt.boxes)
+			continue
+		}
+		for j, box := range boxes {
+			want, _ := time.Parse(time.RFC3339, tt.boxes[j])
+			if !box.Equal(want) {
+				t.Errorf("Test %d: box %d is %v, expected %v", i, j, box, want)
+			}
+			if index := BoxIndex(box, tt.chunk); index != BoxIndex(boxes[0], tt.chunk)+int64(j) {
+				t.Errorf("Test %d: box %d has index %d, expected it to follow on from %d",
+					i, j, index, BoxIndex(boxes[0], tt.chunk))
+			}
+		}
+	}
+}
+
+var localBoxTests = []struct {
+	in     string
+	loc    string
+	res    time.Duration
+	offset time.Duration
+	start  string
+	stop   string
+}{
+	// Days are 23 and 25 hours long when daylight saving time starts and ends
+	{"2013-01-02T23:30:00-05:00", "America/New_York", 24 * time.Hour, 0, "2013-01-02T00:00:00-05:00", "2013-01-03T00:00:00-05:00"},
+	{"2013-03-10T12:00:00-04:00", "America/New_York", 24 * time.Hour, 0, "2013-03-10T00:00:00-05:00", "2013-03-11T00:00:00-04:00"},
+	{"2013-11-03T12:00:00-05:00", "America/New_York", 24 * time.Hour, 0, "2013-11-03T00:00:00-04:00", "2013-11-04T00:00:00-05:00"},
+	// The hour repeated when the clocks go back is two hours
+	{"2013-11-03T01:30:00-04:00", "America/New_York", time.Hour, 0, "2013-11-03T01:00:00-04:00", "2013-11-03T01:00:00-05:00"},
+	{"2013-11-03T01:30:00-05:00", "America/New_York", time.Hour, 0, "2013-11-03T01:00:00-05:00", "2013-11-03T02:00:00-05:00"},
+	{"2013-11-03T01:30:00-05:00", "America/New_York", 2 * time.Hour, 0, "2013-11-03T00:00:00-04:00", "2013-11-03T02:00:00-05:00"},
+	// The hour skipped when the clocks go forward doesn't exist
+	{"2013-03-10T01:30:00-05:00", "America/New_York", time.Hour, 0, "2013-03-10T01:00:00-05:00", "2013-03-10T03:00:00-04:00"},
+	{"2013-03-10T03:10:00-04:00", "America/New_York", 30 * time.Minute, 0, "2013-03-10T03:00:00-04:00", "2013-03-10T03:30:00-04:00"},
+	// Clocks that skip midnight start the day when they go forward
+	{"2013-10-20T12:00:00-02:00", "America/Sao_Paulo", 24 * time.Hour, 0, "2013-10-20T01:00:00-02:00", "2013-10-21T00:00:00-02:00"},
+	{"2013-01-02T10:04:10+05:30", "Asia/Kolkata", time.Hour, 0, "2013-01-02T10:00:00+05:30", "2013-01-02T11:00:00+05:30"},
+	// Offsets shift the timeboxes on the wall clock
+	{"2013-01-02T05:00:00Z", "UTC", 24 * time.Hour, 6 * time.Hour, "2013-01-01T06:00:00Z", "2013-01-02T06:00:00Z"},
+	{"2013-11-03T05:30:00-05:00", "America/New_York", 24 * time.Hour, 6 * time.Hour, "2013-11-02T06:00:00-04:00", "2013-11-03T06:00:00-05:00"},
+	{"2013-01-02T10:20:00Z", "UTC", time.Hour, 15 * time.Minute, "2013-01-02T10:15:00Z", "2013-01-02T11:15:00Z"},
+}
+
+func TestLocalTimeboxing(t *testing.T) {
+	for i, tt := range localBoxTests {
+		loc, err := time.LoadLocation(tt.loc)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		b := New(tt.res, 1, WithLocation(loc), WithOffset(tt.offset)).boxing
+		in, _ := time.Parse(time.RFC3339, tt.in)
+		goodStart, _ := time.Parse(time.RFC3339, tt.start)
+		goodStop, _ := time.Parse(time.RFC3339, tt.stop)
+
+		start, stop := b.boxTime(in)
+		if !start.Equal(goodStart) || !stop.Equal(goodStop) {
+			t.Errorf("Test %d: got %v to %v, expected %v to %v", i, start, stop, goodStart, goodStop)
+			continue
+		}
+		if next := b.step(start, 1); !next.Equal(stop) {
+			t.Errorf("Test %d: step forward got %v, expected %v", i, next, stop)
+		}
+		if prev := b.step(stop, -1); !prev.Equal(start) {
+			t.Errorf("Test %d: step back got %v, expected %v", i, prev, start)
+		}
+		if n := b.count(b.step(start, -3), in); n != 3 {
+			t.Errorf("Test %d: count from three timeboxes back got %d", i, n)
+		}
+	}
+}
+
+var calendarBoxTests = []struct {
+	in     string
+	loc    string
+	unit   Calendar
+	offset time.Duration
+	start  string
+	stop   string
+}{
+	// Weeks start on Monday
+	{"2013-01-02T10:04:10Z", "UTC", Week, 0, "2012-12-31T00:00:00Z", "2013-01-07T00:00:00Z"},
+	{"2013-01-06T23:59:59Z", "UTC", Week, 0, "2012-12-31T00:00:00Z", "2013-01-07T00:00:00Z"},
+	{"2013-01-07T00:00:00Z", "UTC", Week, 0, "2013-01-07T00:00:00Z", "2013-01-14T00:00:00Z"},
+	// Months, quarters and years vary in length
+	{"2013-02-15T10:04:10Z", "UTC", Month, 0, "2013-02-01T00:00:00Z", "2013-03-01T00:00:00Z"},
+	{"2012-02-29T10:04:10Z", "UTC", Month, 0, "2012-02-01T00:00:00Z", "2012-03-01T00:00:00Z"},
+	{"2013-12-31T23:59:59Z", "UTC", Month, 0, "2013-12-01T00:00:00Z", "2014-01-01T00:00:00Z"},
+	{"2013-05-20T10:04:10Z", "UTC", Quarter, 0, "2013-04-01T00:00:00Z", "2013-07-01T00:00:00Z"},
+	{"2013-12-31T23:59:59Z", "UTC", Quarter, 0, "2013-10-01T00:00:00Z", "2014-01-01T00:00:00Z"},
+	{"2012-07-04T10:04:10Z", "UTC", Year, 0, "2012-01-01T00:00:00Z", "2013-01-01T00:00:00Z"},
+	// The calendar is read off the wall clock of the location
+	{"2013-03-20T12:00:00-04:00", "America/New_York", Month, 0, "2013-03-01T00:00:00-05:00", "2013-04-01T00:00:00-04:00"},
+	{"2013-01-31T20:00:00Z", "Asia/Kolkata", Month, 0, "2013-02-01T00:00:00+05:30", "2013-03-01T00:00:00+05:30"},
+	// Offsets shift the start of each unit
+	{"2013-01-07T05:00:00Z", "UTC", Week, 6 * time.Hour, "2012-12-31T06:00:00Z", "2013-01-07T06:00:00Z"},
+	{"2013-11-01T03:00:00-04:00", "America/New_York", Month, 6 * time.Hour, "2013-10-01T06:00:00-04:00", "2013-11-01T06:00:00-04:00"},
+}
+
+func TestCalendarTimeboxing(t *testing.T) {
+	for i, tt := range calendarBoxTests {
+		loc, err := time.LoadLocation(tt.loc)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		b := NewCalendar(tt.unit, 1, WithLocation(loc), WithOffset(tt.offset)).boxing
+		in, _ := time.Parse(time.RFC3339, tt.in)
+		goodStart, _ := time.Parse(time.RFC3339, tt.start)
+		goodStop, _ := time.Parse(time.RFC3339, tt.stop)
+
+		start, stop := b.boxTime(in)
+		if !start.Equal(goodStart) || !stop.Equal(goodStop) {
+			t.Errorf("Test %d: got %v to %v, expected %v to %v", i, start, stop, goodStart, goodStop)
+			continue
+		}
+		if next := b.step(start, 1); !next.Equal(stop) {
+			t.Errorf("Test %d: step forward got %v, expected %v", i, next, stop)
+		}
+		if prev := b.step(stop, -1); !prev.Equal(start) {
+			t.Errorf("Test %d: step back got %v, expected %v", i, prev, start)
+		}
+		if n := b.count(b.step(start, -3), in); n != 3 {
+			t.Errorf("Test %d: count from three timeboxes back got %d", i, n)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+/*
+ * File:	wal.go
+ *
+ * Implements a write-ahead log of the samples added to databases.
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+/*****************************************************************************/
+// A write-ahead log is a sequence of records, one per accepted sample, each
+// laid out little-endian as:
+//
+//	checksum uint32   CRC-32 (Castagnoli) of the rest of the record
+//	nameLen  uint16   length of name
+//	time     int64    time of the sample, in nanoseconds since the epoch
+//	raw      float64  the raw reading
+//	count    uint64   the raw reading as an exact integer (see AddCounterAt)
+//	name     [nameLen]byte  the name of the database in its Mux, if any
+//
+// A crash can leave the last record only partly written, so reading stops at
+// the first record that is incomplete or fails its checksum, and anything
+// after it is discarded when the log is next opened.
+/*****************************************************************************/
+
+const walRecordSize = 4 + 2 + 8 + 8 + 8
+
+// ErrNameTooLong is returned when adding a sample through a Mux with a
+// write-ahead log to a database whose name is too long to record in the log.
+var ErrNameTooLong = errors.New("goaround: database name too long for write-ahead log")
+
+// ErrTimeOutOfRange is returned when adding a sample to a database with a
+// write-ahead log, or through a Mux with one, at a time the log can't record:
+// one too far from the epoch to give in nanoseconds, which is before 1678 or
+// after 2262. The database is not modified.
+var ErrTimeOutOfRange = errors.New("goaround: time out of range for write-ahead log")
+
+// The earliest and latest times a write-ahead log can record.
+var (
+	minWALTime = time.Unix(0, math.MinInt64)
+	maxWALTime = time.Unix(0, math.MaxInt64)
+)
+
+// A WAL is a write-ahead log of samples, kept alongside a saved Db or Mux so
+// that the samples added since the last save survive a crash. Attach it with
+// Db.SetWAL or Mux.SetWAL and every sample the database accepts is appended
+// to the log. On startup, load the last save, then apply the log with Replay
+// or ReplayMux. After each successful save, empty the log with Truncate, or
+// save and empty the log in one step with Db.Checkpoint or Mux.CheckpointDir.
+//
+// Samples are written to the log as they are added, which protects them from
+// the process crashing; call Sync to also protect them from the system
+// crashing.
+//
+// A WAL is safe for concurrent use by multiple goroutines.
+type WAL struct {
+	mu sync.Mutex // guards f
+	f  *os.File
+}
+
+type walRecord struct {
+	name  string
+	t     time.Time
+	raw   float64
+	count uint64
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if it doesn't
+// exist. The log must be closed with Close when it is no longer needed.
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop any partly written record, so that new records follow on from
+	// the last good one.
+	_, n, err := readWAL(f)
+	if err == nil {
+		err = f.Truncate(n)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &WAL{f: f}, nil
+}
+
+// Close closes the log.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// Sync commits the log to stable storage.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Sync()
+}
+
+// Truncate empties the log. Call it once the databases the log is attached to
+// have been saved, never before. Samples added between the save and Truncate
+// are in neither, so adding must be paused across the two; Db.Checkpoint and
+// Mux.CheckpointDir take care of that.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Replay adds every sample in the log to db, which should have just been
+// loaded from its last save. Samples from no later than the database's last
+// update when Replay is called are already in the save, so are skipped, as
+// are any the database rejects with ErrOutOfOrder or ErrBeforeRetention.
+// Replay returns the number of samples added.
+func (w *WAL) Replay(db *Db) (int, error) {
+	return w.replay(func(string) *Db { return db })
+}
+
+// ReplayMux is like Replay, but adds each sample in the log to the database
+// of the same name in mux. Samples for databases that aren't in mux are
+// skipped.
+func (w *WAL) ReplayMux(mux *Mux) (int, error) {
+	return w.replay(func(name string) *Db {
+		db, _ := mux.Get(name)
+		return db
+	})
+}
+
+// replay adds each sample in the log to the database returned by lookup for
+// its name, if any.
+func (w *WAL) replay(lookup func(name string) *Db) (int, error) {
+	w.mu.Lock()
+	recs, _, err := readWAL(w.f)
+	w.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// The last update of each database before replaying. Comparing with
+	// it, rather than letting the database reject old samples, also skips
+	// a sample at the very time of the last update, which a Gauge would
+	// otherwise accept a second time.
+	saved := make(map[*Db]*time.Time) // nil for a database that was empty
+	n := 0
+	for _, rec := range recs {
+		db := lookup(rec.name)
+		if db == nil {
+			continue
+		}
+
+		db.mu.Lock()
+		last, ok := saved[db]
+		if !ok {
+			if db.tail != -1 {
+				t := db.lastEntry
+				last = &t
+			}
+			saved[db] = last
+		}
+		if last != nil && !rec.t.After(*last) {
+			db.mu.Unlock()
+			continue
+		}
+		err := db.add(rec.raw, rec.count, rec.t, false)
+		db.mu.Unlock()
+		switch {
+		case err == nil:
+			n++
+		case errors.Is(err, ErrOutOfOrder), errors.Is(err, ErrBeforeRetention):
+		default:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkWALTime returns ErrTimeOutOfRange if a write-ahead log can't record a
+// sample at time t.
+func checkWALTime(t time.Time) error {
+	if t.Before(minWALTime) || t.After(maxWALTime) {
+		return ErrTimeOutOfRange
+	}
+	return nil
+}
+
+// append adds a record of a sample to the log.
+func (w *WAL) append(name string, raw float64, count uint64, t time.Time) error {
+	if len(name) > math.MaxUint16 {
+		return ErrNameTooLong
+	}
+	if err := checkWALTime(t); err != nil {
+		return err
+	}
+
+	b := make([]byte, walRecordSize+len(name))
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(name)))
+	binary.LittleEndian.PutUint64(b[6:], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(b[14:], math.Float64bits(raw))
+	binary.LittleEndian.PutUint64(b[22:], count)
+	copy(b[walRecordSize:], name)
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.f.Write(b)
+	return err
+}
+
+// size returns the length of the log.
+func (w *WAL) size() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// discard drops the first n bytes of the log, which must end with a record,
+// keeping the records that follow. Those are written to a new file that then
+// replaces the log, so a crash part way through leaves the log as it was.
+func (w *WAL) discard(n int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == n {
+		if err := w.f.Truncate(0); err != nil {
+			return err
+		}
+		return w.f.Sync()
+	}
+
+	rest := make([]byte, info.Size()-n)
+	if _, err := w.f.ReadAt(rest, n); err != nil {
+		return err
+	}
+	path := w.f.Name()
+	if err := writeFileAtomic(path, rest); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	w.f.Close()
+	w.f = f
+	return nil
+}
+
+// readWAL reads the records in the log file f, returning them along with the
+// length of the file they fill. It reads from f itself, rather than its path,
+// so as to read the file the log was opened on even if it has since been
+// renamed or removed.
+func readWAL(f *os.File) ([]walRecord, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var recs []walRecord
+	off := 0
+	for len(data)-off >= walRecordSize {
+		b := data[off:]
+		n := walRecordSize + int(binary.LittleEndian.Uint16(b[4:]))
+		if len(b) < n || crc32.Checksum(b[4:n], crcTable) != binary.LittleEndian.Uint32(b) {
+			break
+		}
+
+		recs = append(recs, walRecord{
+			name:  string(b[walRecordSize:n]),
+			t:     time.Unix(0, int64(binary.LittleEndian.Uint64(b[6:]))),
+			raw:   math.Float64frombits(binary.LittleEndian.Uint64(b[14:])),
+			count: binary.LittleEndian.Uint64(b[22:]),
+		})
+		off += n
+	}
+	return recs, int64(off), nil
+}
+
+// SetWAL attaches the write-ahead log w to the database, so that every sample
+// the database accepts from now on is appended to it. A nil w detaches the
+// database's log.
+func (db *Db) SetWAL(w *WAL) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.wal = w
+}
+
+// SetWAL attaches the write-ahead log w to the Mux, so that every sample a
+// database accepts through the Mux from now on is appended to it, along with
+// the database's name. A nil w detaches the Mux's log.
+func (mux *Mux) SetWAL(w *WAL) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.wal = w
+}
+
+// Checkpoint saves the database to the file at path, as SaveFile does, and
+// then drops the samples the save holds from its write-ahead log, if it has
+// one (see SetWAL). Samples added while the save is written stay in the log,
+// so none is lost, and adding them only waits for the database to be copied,
+// not for the copy to be written. The log must not also be shared with other
+// databases or a Mux, as their samples would be lost.
+func (db *Db) Checkpoint(path string) error {
+	db.mu.RLock()
+	s, w := db.snapshot(), db.wal
+	var logged int64
+	var err error
+	if w != nil {
+		logged, err = w.size()
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.SaveFile(path); err != nil {
+		return err
+	}
+	if w == nil {
+		return nil
+	}
+	return w.discard(logged)
+}
+
+// CheckpointDir saves the Mux to directory dir, as SaveDir does, and then
+// empties its write-ahead log, if it has one (see SetWAL). Samples added
+// through the Mux wait until both are done, so none is lost between them.
+func (mux *Mux) CheckpointDir(dir string) error {
+	mux.logMu.Lock()
+	defer mux.logMu.Unlock()
+
+	if err := mux.SaveDir(dir); err != nil {
+		return err
+	}
+	mux.mu.RLock()
+	w := mux.wal
+	mux.mu.RUnlock()
+	if w == nil {
+		return nil
+	}
+	return w.Truncate()
+}
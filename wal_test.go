@@ -0,0 +1,321 @@
+/*
+ * File:	wal_test.go
+ *
+ * Implements tests for the wal.go functionality
+ *
+ *
+ * Copyright (c) 2013, Matthew R. Wilson <mwilson@mattwilson.org>.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met: 
+ * 
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer. 
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution. 
+ * 
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package goaround
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "test.gar")
+	log := filepath.Join(dir, "test.wal")
+
+	w, err := OpenWAL(log)
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	db := New(30*time.Second, 5, WithConsolidation(Average, Max))
+	db.SetWAL(w)
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	for i := 0; i < 5; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+	if err := db.SaveFile(snapshot); err != nil {
+		t.Fatalf("db.SaveFile returned %v", err)
+	}
+	if err := w.Truncate(); err != nil {
+		t.Fatalf("w.Truncate returned %v", err)
+	}
+
+	// Samples after the save, one of them rejected and so not logged
+	for i := 5; i < 12; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+	db.AddAt(99, base)
+	db.AddCounterAt(1<<40, base.Add(250*time.Second))
+	w.Close()
+
+	// Crash part way through writing a record
+	f, _ := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Close()
+
+	w, err = OpenWAL(log)
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+	restored := new(Db)
+	if err := restored.LoadFile(snapshot); err != nil {
+		t.Fatalf("restored.LoadFile returned %v", err)
+	}
+	if n, err := w.Replay(restored); err != nil || n != 8 {
+		t.Errorf("w.Replay returned %d, %v; expected 8, nil", n, err)
+	}
+	if !restored.equals(db) {
+		t.Errorf("Replayed db does not match the original")
+	}
+
+	// Replaying again changes nothing, as the samples are already there
+	if _, err := w.Replay(restored); err != nil {
+		t.Errorf("second w.Replay returned %v", err)
+	}
+	if !restored.equals(db) {
+		t.Errorf("Replaying twice changed the db")
+	}
+
+	// The partial record was dropped, so new records can be read back
+	restored.SetWAL(w)
+	restored.AddAt(7, base.Add(300*time.Second))
+	again := db.Snapshot()
+	again.AddAt(7, base.Add(300*time.Second))
+	db.SetWAL(nil)
+	db.LoadFile(snapshot)
+	if n, _ := w.Replay(db); n != 9 {
+		t.Errorf("w.Replay after appending replayed %d samples, expected 9", n)
+	}
+	if !db.equals(again) {
+		t.Errorf("Replayed db does not match the original")
+	}
+}
+
+// A Gauge accepts a sample at the time of its last update, so replaying must
+// not add the last sample before the save a second time
+func TestWALReplaySnapshot(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "test.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5, WithConsolidation(Sum, Count))
+	db.SetWAL(w)
+	db.AddAt(1, base)
+	db.AddAt(2, base.Add(10*time.Second))
+	b, _ := db.GobEncode()
+
+	// More samples after the snapshot, two of them at the same time
+	db.AddAt(3, base.Add(20*time.Second))
+	db.AddAt(4, base.Add(20*time.Second))
+
+	restored := new(Db)
+	if err := restored.GobDecode(b); err != nil {
+		t.Fatalf("GobDecode returned %v", err)
+	}
+	if n, err := w.Replay(restored); err != nil || n != 2 {
+		t.Errorf("w.Replay returned %d, %v; expected 2, nil", n, err)
+	}
+	if !restored.equals(db) {
+		t.Errorf("Replayed db has sum %v and count %v, expected %v and %v",
+			restored.Get(0), restored.GetCF(0, Count), db.Get(0), db.GetCF(0, Count))
+	}
+}
+
+// The log is read from the file it was opened on, wherever that has gone
+func TestWALMoved(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(filepath.Join(dir, "test.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5)
+	db.SetWAL(w)
+	for i := 0; i < 5; i++ {
+		db.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+	os.Rename(filepath.Join(dir, "test.wal"), filepath.Join(dir, "moved.wal"))
+	os.WriteFile(filepath.Join(dir, "test.wal"), nil, 0666)
+
+	if n, err := w.Replay(New(30*time.Second, 5)); err != nil || n != 5 {
+		t.Errorf("w.Replay returned %d, %v; expected 5, nil", n, err)
+	}
+}
+
+func TestWALMux(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "test.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	mux := NewMux()
+	mux.AddDb("fine", New(30*time.Second, 5))
+	mux.AddDb("coarse", New(120*time.Second, 5))
+	mux.SetWAL(w)
+	for i := 0; i < 10; i++ {
+		mux.AddAt(float32(i), base.Add(time.Duration(i*20)*time.Second))
+	}
+
+	restored := NewMux()
+	restored.AddDb("fine", New(30*time.Second, 5))
+	restored.AddDb("coarse", New(120*time.Second, 5))
+	if n, err := w.ReplayMux(restored); err != nil || n != 20 {
+		t.Errorf("w.ReplayMux returned %d, %v; expected 20, nil", n, err)
+	}
+	for _, name := range mux.Names() {
+		a, _ := mux.Get(name)
+		b, _ := restored.Get(name)
+		if !a.equals(b) {
+			t.Errorf("Replayed db %s does not match the original", name)
+		}
+	}
+
+	// Databases missing from the Mux are skipped
+	restored.Remove("coarse")
+	restored.AddDb("fine", New(30*time.Second, 5))
+	if n, err := w.ReplayMux(restored); err != nil || n != 10 {
+		t.Errorf("w.ReplayMux returned %d, %v; expected 10, nil", n, err)
+	}
+}
+
+func TestWALTimeRange(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "test.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+
+	old := time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := New(30*time.Second, 5)
+	db.SetWAL(w)
+	if err := db.AddAt(1, old); !errors.Is(err, ErrTimeOutOfRange) || db.Len() != 0 {
+		t.Errorf("db.AddAt returned %v, expected ErrTimeOutOfRange and no change", err)
+	}
+	mux := NewMux()
+	mux.AddDb("a", New(30*time.Second, 5))
+	mux.SetWAL(w)
+	if err := mux.AddAt(1, old.AddDate(700, 0, 0)); !errors.Is(err, ErrTimeOutOfRange) {
+		t.Errorf("mux.AddAt returned %v, expected ErrTimeOutOfRange", err)
+	}
+
+	// Without a log, any time will do
+	db.SetWAL(nil)
+	if err := db.AddAt(1, old); err != nil {
+		t.Errorf("db.AddAt without a log returned %v", err)
+	}
+}
+
+// Checkpointing while samples are added loses none of them
+func TestWALCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(filepath.Join(dir, "db.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+	mw, err := OpenWAL(filepath.Join(dir, "mux.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer mw.Close()
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 50, WithConsolidation(Sum, Count))
+	db.SetWAL(w)
+	mux := NewMux()
+	mux.AddDb("a", New(30*time.Second, 50, WithConsolidation(Sum, Count)))
+	mux.SetWAL(mw)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			tm := base.Add(time.Duration(i) * time.Second)
+			db.AddAt(float32(i), tm)
+			mux.AddAt(float32(i), tm)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := db.Checkpoint(filepath.Join(dir, "db.gar")); err != nil {
+			t.Fatalf("db.Checkpoint returned %v", err)
+		}
+		if err := mux.CheckpointDir(filepath.Join(dir, "mux")); err != nil {
+			t.Fatalf("mux.CheckpointDir returned %v", err)
+		}
+	}
+	<-done
+
+	restored := new(Db)
+	if err := restored.LoadFile(filepath.Join(dir, "db.gar")); err != nil {
+		t.Fatalf("LoadFile returned %v", err)
+	}
+	if _, err := w.Replay(restored); err != nil || !restored.equals(db) {
+		t.Errorf("w.Replay returned %v, or a db that does not match the original", err)
+	}
+	restoredMux, err := LoadDir(filepath.Join(dir, "mux"))
+	if err != nil {
+		t.Fatalf("LoadDir returned %v", err)
+	}
+	a, _ := mux.Get("a")
+	b, _ := restoredMux.Get("a")
+	if _, err := mw.ReplayMux(restoredMux); err != nil || !b.equals(a) {
+		t.Errorf("mw.ReplayMux returned %v, or a db that does not match the original", err)
+	}
+}
+
+// Samples logged after a checkpoint's copy of the database was taken are kept
+func TestWALDiscard(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "test.wal"))
+	if err != nil {
+		t.Fatalf("OpenWAL returned %v", err)
+	}
+	defer w.Close()
+
+	base, _ := time.Parse(time.RFC3339, "2013-01-01T08:00:00Z")
+	db := New(30*time.Second, 5)
+	db.SetWAL(w)
+	db.AddAt(1, base)
+	db.AddAt(2, base.Add(20*time.Second))
+	n, _ := w.size()
+	db.AddAt(3, base.Add(40*time.Second))
+	db.AddAt(4, base.Add(60*time.Second))
+	if err := w.discard(n); err != nil {
+		t.Fatalf("w.discard returned %v", err)
+	}
+
+	// The log is still appended to after its file is replaced
+	db.AddAt(5, base.Add(80*time.Second))
+	if n, err := w.Replay(New(30*time.Second, 5)); err != nil || n != 3 {
+		t.Errorf("w.Replay returned %d, %v; expected 3, nil", n, err)
+	}
+}